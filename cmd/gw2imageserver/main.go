@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/ptolstoi/gw2imageserver/internal/gw2imageserver"
@@ -21,17 +26,157 @@ func main() {
 	fmt.Printf("\n\n\n\n\n\nStarting GW2ImageServer\n=======================\n")
 
 	listenOn := "localhost:7089"
+	exportTo := ""
+	bundleCommand, bundlePath := "", ""
+	s3Endpoint := neversorrow.EnvOr("CACHE_S3_ENDPOINT", "https://s3.amazonaws.com")
 
-	if len(os.Args) > 1 {
+	if len(os.Args) > 2 && os.Args[1] == "export" {
+		exportTo = os.Args[2]
+	} else if len(os.Args) > 3 && os.Args[1] == "bundle" {
+		bundleCommand, bundlePath = os.Args[2], os.Args[3]
+	} else if len(os.Args) > 1 {
 		listenOn = os.Args[1]
 	}
 
-	config := neversorrow.Config{
-		Address: neversorrow.EnvOr("ADDRESS", listenOn),
+	config := gw2imageserver.Config{
+		Config: neversorrow.Config{
+			Address: neversorrow.EnvOr("ADDRESS", listenOn),
 
-		Version:        _version,
-		BuildTime:      _buildTime,
-		ShowStacktrace: _showStacktrace == "",
+			Version:        _version,
+			BuildTime:      _buildTime,
+			ShowStacktrace: _showStacktrace == "",
+		},
+
+		Upstream: gw2imageserver.UpstreamConfig{
+			Disabled: envBool("UPSTREAM_DISABLED", false),
+
+			Mirrors:  envList("UPSTREAM_MIRRORS", "http://assetcdn.101.ArenaNetworks.com"),
+			FilePath: neversorrow.EnvOr("UPSTREAM_FILE_PATH", "/program/101/1/0/{file}"),
+
+			LatestPath:   neversorrow.EnvOr("UPSTREAM_LATEST_PATH", "/latest/101"),
+			ManifestPath: neversorrow.EnvOr("UPSTREAM_MANIFEST_PATH", "/manifest/program/101/{build}"),
+
+			Headers: envPairs("UPSTREAM_HEADERS", ":", ""),
+			Cookies: envPairs("UPSTREAM_COOKIES", "=", "authCookie=access=/latest/*!/manifest/program/*!/program/*~md5=4e51ad868f87201ad93e428ff30c6691"),
+
+			Timeout: envDuration("UPSTREAM_TIMEOUT", 15*time.Second),
+
+			MaxAttempts: envInt("UPSTREAM_MAX_ATTEMPTS", 3),
+			BackoffBase: envDuration("UPSTREAM_BACKOFF_BASE", 200*time.Millisecond),
+			BackoffMax:  envDuration("UPSTREAM_BACKOFF_MAX", 5*time.Second),
+
+			BreakerThreshold: envInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:  envDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second),
+
+			RateLimit:     envFloat("UPSTREAM_RATE_LIMIT", 0),
+			RateBurst:     envInt("UPSTREAM_RATE_BURST", 10),
+			MaxConcurrent: envInt("UPSTREAM_MAX_CONCURRENT", 8),
+
+			Cassette: gw2imageserver.CassetteConfig{
+				Mode:      neversorrow.EnvOr("UPSTREAM_CASSETTE_MODE", ""),
+				Directory: neversorrow.EnvOr("UPSTREAM_CASSETTE_DIR", "./cassettes"),
+			},
+
+			Faults: envFaults("UPSTREAM_FAULTS"),
+		},
+
+		Manifest: gw2imageserver.ManifestConfig{
+			Refresh: envDuration("MANIFEST_REFRESH", 10*time.Minute),
+		},
+
+		Archive: gw2imageserver.ArchiveConfig{
+			Path: neversorrow.EnvOr("ARCHIVE_PATH", ""),
+		},
+
+		Admin: gw2imageserver.AdminConfig{
+			Token: neversorrow.EnvOr("ADMIN_TOKEN", ""),
+		},
+
+		Cache: gw2imageserver.CacheConfig{
+			Backend: neversorrow.EnvOr("CACHE_BACKEND", "sqlite"),
+
+			SQLite: gw2imageserver.SQLiteConfig{
+				Path:        neversorrow.EnvOr("CACHE_DB_PATH", "./cache.db"),
+				Readers:     envInt("CACHE_DB_READERS", 2*runtime.NumCPU()),
+				BusyTimeout: envDuration("CACHE_DB_BUSY_TIMEOUT", 5*time.Second),
+			},
+
+			Directory: neversorrow.EnvOr("CACHE_DIR", "./cache"),
+
+			S3: gw2imageserver.S3Config{
+				Endpoint: s3Endpoint,
+				Region:   neversorrow.EnvOr("CACHE_S3_REGION", "us-east-1"),
+				Bucket:   neversorrow.EnvOr("CACHE_S3_BUCKET", ""),
+				Prefix:   neversorrow.EnvOr("CACHE_S3_PREFIX", ""),
+
+				AccessKey: neversorrow.EnvOr("CACHE_S3_ACCESS_KEY", ""),
+				SecretKey: neversorrow.EnvOr("CACHE_S3_SECRET_KEY", ""),
+
+				PathStyle: envBool("CACHE_S3_PATH_STYLE", !gw2imageserver.IsAWSEndpoint(s3Endpoint)),
+				Timeout:   envDuration("CACHE_S3_TIMEOUT", 30*time.Second),
+			},
+
+			MemoryBytes: envInt("CACHE_MEMORY_BYTES", 64<<20),
+
+			MaxBytes:      int64(envInt("CACHE_MAX_BYTES", 0)),
+			EvictInterval: envDuration("CACHE_EVICT_INTERVAL", time.Minute),
+			EvictPolicy:   neversorrow.EnvOr("CACHE_EVICT_POLICY", "lru"),
+
+			VerifyReads:   envFloat("CACHE_VERIFY_READS", 1),
+			ScrubInterval: envDuration("CACHE_SCRUB_INTERVAL", 24*time.Hour),
+
+			Policy: neversorrow.EnvOr("CACHE_POLICY", "cache-first"),
+
+			TTLs:       envDurations("CACHE_TTLS"),
+			DefaultTTL: envDuration("CACHE_TTL", 24*time.Hour),
+			MaxStale:   envDuration("CACHE_MAX_STALE", 7*24*time.Hour),
+
+			RefreshRetry: envDuration("CACHE_REFRESH_RETRY", time.Minute),
+		},
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(config, os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(config)
+		return
+	}
+
+	if exportTo != "" {
+		exportConfig := gw2imageserver.ExportConfig{
+			Directory: exportTo,
+			Workers:   envInt("EXPORT_WORKERS", runtime.NumCPU()),
+		}
+
+		if err := gw2imageserver.Export(config, exportConfig); err != nil {
+			log.Fatalf("export failed: %v", err)
+		}
+		return
+	}
+
+	switch bundleCommand {
+	case "":
+	case "export":
+		filter := gw2imageserver.BundleFilter{
+			MinID:     uint64(envInt("BUNDLE_MIN_ID", 0)),
+			MaxID:     uint64(envInt("BUNDLE_MAX_ID", 0)),
+			FileTypes: envList("BUNDLE_TYPES", ""),
+		}
+
+		if err := gw2imageserver.ExportBundle(config, bundlePath, filter); err != nil {
+			log.Fatalf("bundle export failed: %v", err)
+		}
+		return
+	case "import":
+		if err := gw2imageserver.ImportBundle(config, bundlePath); err != nil {
+			log.Fatalf("bundle import failed: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("usage: %v bundle export|import <file>", os.Args[0])
 	}
 
 	app, err := gw2imageserver.NewApp(config)
@@ -45,3 +190,150 @@ func main() {
 		log.Fatalf("error: %v", err)
 	}
 }
+
+// runMigrate implements "migrate [status|up]" for cache.db.
+func runMigrate(config gw2imageserver.Config, args []string) {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "status":
+	case "up":
+		if err := gw2imageserver.Migrate(config); err != nil {
+			log.Fatalf("migration failed: %v", err)
+		}
+	default:
+		log.Fatalf("usage: %v migrate [status|up]", os.Args[0])
+	}
+
+	migrations, err := gw2imageserver.Migrations(config)
+	if err != nil {
+		log.Fatalf("couldn't read migrations: %v", err)
+	}
+
+	for _, migration := range migrations {
+		state := "pending"
+		if migration.Applied {
+			state = "applied " + migration.AppliedAt.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%4d  %-30s  %v\n", migration.Version, state, migration.Name)
+	}
+}
+
+// runBench implements "bench", a load benchmark of the SQLite cache.
+func runBench(config gw2imageserver.Config) {
+	bench := gw2imageserver.BenchConfig{
+		Writers:  envInt("BENCH_WRITERS", 4),
+		Readers:  envInt("BENCH_READERS", 4*runtime.NumCPU()),
+		Files:    envInt("BENCH_FILES", 1000),
+		Size:     envInt("BENCH_SIZE", 64*1024),
+		Duration: envDuration("BENCH_DURATION", 10*time.Second),
+	}
+
+	result, err := gw2imageserver.Benchmark(config, bench)
+	if err != nil {
+		log.Fatalf("bench failed: %v", err)
+	}
+
+	fmt.Printf("writes %v\nreads  %v\n", result.Writes, result.Reads)
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(neversorrow.EnvOr(key, strconv.Itoa(fallback)))
+	if err != nil {
+		log.Fatalf("invalid %v: %v", key, err)
+	}
+
+	return value
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(neversorrow.EnvOr(key, strconv.FormatFloat(fallback, 'f', -1, 64)), 64)
+	if err != nil {
+		log.Fatalf("invalid %v: %v", key, err)
+	}
+
+	return value
+}
+
+func envBool(key string, fallback bool) bool {
+	value, err := strconv.ParseBool(neversorrow.EnvOr(key, strconv.FormatBool(fallback)))
+	if err != nil {
+		log.Fatalf("invalid %v: %v", key, err)
+	}
+
+	return value
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(neversorrow.EnvOr(key, fallback.String()))
+	if err != nil {
+		log.Fatalf("invalid %v: %v", key, err)
+	}
+
+	return value
+}
+
+// envDurations parses "name=duration" pairs delimited by ";".
+func envDurations(key string) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+
+	for name, value := range envPairs(key, "=", "") {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("invalid %v: %v", key, err)
+		}
+
+		durations[name] = duration
+	}
+
+	return durations
+}
+
+// envFaults reads the initial fault injection settings as JSON.
+func envFaults(key string) gw2imageserver.FaultConfig {
+	faults := gw2imageserver.FaultConfig{}
+
+	if value := neversorrow.EnvOr(key, ""); value != "" {
+		if err := json.Unmarshal([]byte(value), &faults); err != nil {
+			log.Fatalf("invalid %v: %v", key, err)
+		}
+	}
+
+	return faults
+}
+
+func envList(key string, fallback string) []string {
+	var list []string
+
+	for _, item := range strings.Split(neversorrow.EnvOr(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// envPairs parses "name<separator>value" pairs delimited by ";".
+func envPairs(key string, separator string, fallback string) map[string]string {
+	pairs := map[string]string{}
+
+	for _, item := range strings.Split(neversorrow.EnvOr(key, fallback), ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, separator, 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid %v: expected name%svalue, got %q", key, separator, item)
+		}
+
+		pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return pairs
+}
@@ -3,6 +3,6 @@ module github.com/ptolstoi/gw2imageserver
 go 1.15
 
 require (
-	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/ptolstoi/neversorrow v1.0.0
 )
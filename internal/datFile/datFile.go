@@ -0,0 +1,280 @@
+package datFile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ptolstoi/gw2imageserver/internal/datInflater"
+)
+
+const (
+	magicAN  = "AN\x1A"
+	magicMft = "Mft\x1A"
+
+	headerSize   = 40
+	mftEntrySize = 24
+
+	// the first entries of the MFT describe the archive itself
+	mftIndexFileIDTable = 2
+
+	compressionFlagInflate uint16 = 0x8
+)
+
+type header struct {
+	version    uint8
+	headerSize uint32
+	chunkSize  uint32
+	mftOffset  uint64
+	mftSize    uint32
+	flags      uint32
+}
+
+type mftEntry struct {
+	offset          uint64
+	size            uint32
+	compressionFlag uint16
+	entryFlags      uint16
+	counter         uint32
+	crc             uint32
+}
+
+type Entry struct {
+	BaseID     uint32
+	FileID     uint32
+	Size       uint32
+	Compressed bool
+
+	mftIndex uint32
+}
+
+type Archive struct {
+	file *os.File
+	size uint64
+
+	header  header
+	entries []mftEntry
+
+	byID    map[uint32]uint32
+	byIndex map[uint32]*Entry
+}
+
+// Open reads the header, the MFT and the file ID table of a Gw2.dat archive.
+// Entry contents are read on demand.
+func Open(path string) (*Archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	archive := Archive{
+		file: file,
+		size: uint64(info.Size()),
+	}
+
+	if err := archive.readHeader(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := archive.readMft(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := archive.readFileIDTable(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &archive, nil
+}
+
+func (archive *Archive) Close() error {
+	return archive.file.Close()
+}
+
+func (archive *Archive) readHeader() error {
+	data := make([]byte, headerSize)
+	if _, err := archive.file.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("couldn't read archive header: %v", err)
+	}
+
+	if string(data[1:4]) != magicAN {
+		return fmt.Errorf("not a dat archive")
+	}
+
+	archive.header = header{
+		version:    data[0],
+		headerSize: binary.LittleEndian.Uint32(data[4:8]),
+		chunkSize:  binary.LittleEndian.Uint32(data[12:16]),
+		mftOffset:  binary.LittleEndian.Uint64(data[24:32]),
+		mftSize:    binary.LittleEndian.Uint32(data[32:36]),
+		flags:      binary.LittleEndian.Uint32(data[36:40]),
+	}
+
+	return nil
+}
+
+// readMft reads the MFT, whose header occupies the slot of entry 0.
+func (archive *Archive) readMft() error {
+	if err := archive.checkRange(archive.header.mftOffset, archive.header.mftSize); err != nil {
+		return fmt.Errorf("invalid MFT: %v", err)
+	}
+
+	data := make([]byte, archive.header.mftSize)
+	if _, err := archive.file.ReadAt(data, int64(archive.header.mftOffset)); err != nil {
+		return fmt.Errorf("couldn't read MFT: %v", err)
+	}
+
+	if len(data) < mftEntrySize || string(data[0:4]) != magicMft {
+		return fmt.Errorf("invalid MFT header")
+	}
+
+	count := binary.LittleEndian.Uint32(data[12:16])
+	if uint64(count)*mftEntrySize > uint64(len(data)) {
+		return fmt.Errorf("MFT announces %v entries but has room for %v", count, len(data)/mftEntrySize)
+	}
+
+	archive.entries = make([]mftEntry, count)
+
+	var i uint32
+	for i = 1; i < count; i++ {
+		raw := data[i*mftEntrySize : (i+1)*mftEntrySize]
+
+		archive.entries[i] = mftEntry{
+			offset:          binary.LittleEndian.Uint64(raw[0:8]),
+			size:            binary.LittleEndian.Uint32(raw[8:12]),
+			compressionFlag: binary.LittleEndian.Uint16(raw[12:14]),
+			entryFlags:      binary.LittleEndian.Uint16(raw[14:16]),
+			counter:         binary.LittleEndian.Uint32(raw[16:20]),
+			crc:             binary.LittleEndian.Uint32(raw[20:24]),
+		}
+	}
+
+	return nil
+}
+
+// readFileIDTable maps IDs to MFT entries. An entry is referenced by up to two
+// IDs: the lower one is its base ID, the higher one its current file ID.
+func (archive *Archive) readFileIDTable() error {
+	if len(archive.entries) <= mftIndexFileIDTable {
+		return fmt.Errorf("MFT has no file ID table")
+	}
+
+	data, err := archive.readEntry(archive.entries[mftIndexFileIDTable])
+	if err != nil {
+		return fmt.Errorf("couldn't read file ID table: %v", err)
+	}
+
+	archive.byID = make(map[uint32]uint32, len(data)/8)
+	archive.byIndex = map[uint32]*Entry{}
+
+	for position := 0; position+8 <= len(data); position += 8 {
+		id := binary.LittleEndian.Uint32(data[position : position+4])
+		mftIndex := binary.LittleEndian.Uint32(data[position+4 : position+8])
+
+		if id == 0 || mftIndex == 0 || mftIndex >= uint32(len(archive.entries)) {
+			continue
+		}
+
+		archive.byID[id] = mftIndex
+
+		entry, ok := archive.byIndex[mftIndex]
+		if !ok {
+			mft := archive.entries[mftIndex]
+
+			archive.byIndex[mftIndex] = &Entry{
+				BaseID:     id,
+				FileID:     id,
+				Size:       mft.size,
+				Compressed: mft.compressionFlag&compressionFlagInflate != 0,
+
+				mftIndex: mftIndex,
+			}
+			continue
+		}
+
+		if id < entry.BaseID {
+			entry.BaseID = id
+		}
+		if id > entry.FileID {
+			entry.FileID = id
+		}
+	}
+
+	return nil
+}
+
+// checkRange rejects ranges beyond the end of the archive before anything is
+// allocated for them.
+func (archive *Archive) checkRange(offset uint64, size uint32) error {
+	if offset > archive.size || uint64(size) > archive.size-offset {
+		return fmt.Errorf("%v bytes at %v exceed the archive size of %v", size, offset, archive.size)
+	}
+
+	return nil
+}
+
+func (archive *Archive) readEntry(entry mftEntry) ([]byte, error) {
+	if err := archive.checkRange(entry.offset, entry.size); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, entry.size)
+
+	if _, err := archive.file.ReadAt(data, int64(entry.offset)); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if entry.compressionFlag&compressionFlagInflate == 0 {
+		return data, nil
+	}
+
+	return datInflater.Inflate(data, 0)
+}
+
+// Lookup returns the entry referenced by a base or file ID.
+func (archive *Archive) Lookup(id uint32) (Entry, bool) {
+	mftIndex, ok := archive.byID[id]
+	if !ok {
+		return Entry{}, false
+	}
+
+	return *archive.byIndex[mftIndex], true
+}
+
+// ReadFile returns the inflated content of the entry referenced by a base or
+// file ID, or nil if the archive doesn't contain it.
+func (archive *Archive) ReadFile(id uint32) ([]byte, error) {
+	entry, ok := archive.Lookup(id)
+	if !ok {
+		return nil, nil
+	}
+
+	return archive.Read(entry)
+}
+
+func (archive *Archive) Read(entry Entry) ([]byte, error) {
+	return archive.readEntry(archive.entries[entry.mftIndex])
+}
+
+// Entries lists every referenced entry ordered by base ID.
+func (archive *Archive) Entries() []Entry {
+	entries := make([]Entry, 0, len(archive.byIndex))
+	for _, entry := range archive.byIndex {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].BaseID < entries[j].BaseID
+	})
+
+	return entries
+}
@@ -0,0 +1,53 @@
+package datFile
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeArchive(t *testing.T, mftOffset uint64, mftSize uint32) string {
+	data := make([]byte, headerSize)
+	data[0] = 0x97
+	copy(data[1:4], magicAN)
+	binary.LittleEndian.PutUint32(data[4:8], headerSize)
+	binary.LittleEndian.PutUint64(data[24:32], mftOffset)
+	binary.LittleEndian.PutUint32(data[32:36], mftSize)
+
+	directory, err := ioutil.TempDir("", "datFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(directory) })
+
+	path := filepath.Join(directory, "Gw2.dat")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestOpenRejectsMftBeyondEnd(t *testing.T) {
+	for _, mft := range []struct {
+		offset uint64
+		size   uint32
+	}{
+		{headerSize, 0xFFFFFFFF},
+		{0xFFFFFFFFFFFFFFFF, 24},
+	} {
+		if _, err := Open(writeArchive(t, mft.offset, mft.size)); err == nil {
+			t.Errorf("want an error for an MFT of %v bytes at %v", mft.size, mft.offset)
+		}
+	}
+}
+
+func TestReadEntryRejectsRangesBeyondEnd(t *testing.T) {
+	archive := Archive{size: 100}
+
+	if _, err := archive.readEntry(mftEntry{offset: 50, size: 0xFFFFFFFF}); err == nil {
+		t.Fatal("want an error for an entry beyond the end of the archive")
+	}
+}
@@ -0,0 +1,418 @@
+package datInflater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ptolstoi/gw2imageserver/internal/huffman"
+)
+
+const (
+	maxSymbols uint16 = 285
+
+	copySizeLongCode uint16 = 28
+
+	// MaxOutputSize bounds the output of Inflate unless the caller knows a
+	// tighter limit. The size comes from the data itself, so without a bound
+	// garbage could allocate gigabytes.
+	MaxOutputSize uint32 = 64 << 20
+)
+
+var dictionaryTree = huffman.NewDictionaryTree()
+
+type inflaterState struct {
+	input     []uint32
+	inputSize uint32
+	inputPos  uint32
+
+	head   uint32
+	buffer uint32
+	bits   uint8
+
+	isEmpty bool
+}
+
+func newInflaterState(input *[]uint32) *inflaterState {
+	state := inflaterState{
+		input:     *input,
+		inputSize: uint32(len(*input)),
+		inputPos:  0,
+
+		head:   0,
+		bits:   0,
+		buffer: 0,
+
+		isEmpty: false,
+	}
+	return &state
+}
+
+// OutputSize returns the uncompressed size stored in the header of a
+// compressed buffer.
+func OutputSize(inputRaw []byte) (uint32, error) {
+	if len(inputRaw) < 8 {
+		return 0, fmt.Errorf("compressed data too small")
+	}
+
+	return binary.LittleEndian.Uint32(inputRaw[4:8]), nil
+}
+
+// Inflate decompresses data in ArenaNet's archive compression format. Data
+// announcing more than maxOutputSize bytes is rejected, a maxOutputSize of 0
+// means MaxOutputSize.
+func Inflate(inputRaw []byte, maxOutputSize uint32) (output []byte, err error) {
+	// malformed trees can point outside of the symbol tables
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = nil, fmt.Errorf("corrupt compressed data: %v", r)
+		}
+	}()
+
+	if len(inputRaw) < 8 {
+		return nil, fmt.Errorf("compressed data too small")
+	}
+
+	// the bit reader consumes whole words
+	if padding := len(inputRaw) % 4; padding != 0 {
+		inputRaw = append(inputRaw[:len(inputRaw):len(inputRaw)], make([]byte, 4-padding)...)
+	}
+
+	input := make([]uint32, len(inputRaw)/4)
+	if err := binary.Read(bytes.NewBuffer(inputRaw[:]), binary.LittleEndian, &input); err != nil {
+		return nil, err
+	}
+
+	state := newInflaterState(&input)
+
+	// skip header
+	if err := state.needBits(32); err != nil {
+		return nil, err
+	}
+	if err := state.dropBits(32); err != nil {
+		return nil, err
+	}
+
+	if err := state.needBits(32); err != nil {
+		return nil, err
+	}
+	anOutputSize := state.readBits(32)
+	if err := state.dropBits(32); err != nil {
+		return nil, err
+	}
+
+	if maxOutputSize == 0 {
+		maxOutputSize = MaxOutputSize
+	}
+	if anOutputSize > maxOutputSize {
+		return nil, fmt.Errorf("output size %v exceeds the limit of %v", anOutputSize, maxOutputSize)
+	}
+
+	output = make([]uint8, anOutputSize)
+
+	if err := state.inflateData(&output); err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (state *inflaterState) inflateData(ptr *[]uint8) error {
+	ioOutputTab := *ptr
+	anOutputSize := uint32(len(ioOutputTab))
+	var anOutputPos uint32
+
+	// constant added to every copy size
+	if err := state.needBits(8); err != nil {
+		return err
+	}
+	if err := state.dropBits(4); err != nil {
+		return err
+	}
+	aWriteSizeConstAdd := state.readBits(4) + 1
+	if err := state.dropBits(4); err != nil {
+		return err
+	}
+
+	for anOutputPos < anOutputSize {
+		symbolTree, err := state.parseHuffmanTree()
+		if err != nil {
+			return err
+		}
+		copyTree, err := state.parseHuffmanTree()
+		if err != nil {
+			return err
+		}
+		if symbolTree.IsEmpty() || copyTree.IsEmpty() {
+			return fmt.Errorf("empty huffman tree at output position %v of %v", anOutputPos, anOutputSize)
+		}
+
+		if err := state.needBits(4); err != nil {
+			return err
+		}
+		aMaxCount := (state.readBits(4) + 1) << 12
+		if err := state.dropBits(4); err != nil {
+			return err
+		}
+
+		var aCurrentCodeReadCount uint32
+		for aCurrentCodeReadCount < aMaxCount && anOutputPos < anOutputSize {
+			aCurrentCodeReadCount++
+
+			aCode, err := state.readCode(symbolTree)
+			if err != nil {
+				return err
+			}
+
+			if aCode < 0x100 {
+				ioOutputTab[anOutputPos] = uint8(aCode)
+				anOutputPos++
+				continue
+			}
+
+			aWriteSize, err := state.readWriteSize(aCode-0x100, aWriteSizeConstAdd)
+			if err != nil {
+				return err
+			}
+
+			aWriteOffset, err := state.readWriteOffset(copyTree)
+			if err != nil {
+				return err
+			}
+
+			if aWriteOffset > anOutputPos {
+				return fmt.Errorf("copy offset %v before start of output at %v", aWriteOffset, anOutputPos)
+			}
+
+			var anAlreadyWritten uint32
+			for anAlreadyWritten < aWriteSize && anOutputPos < anOutputSize {
+				ioOutputTab[anOutputPos] = ioOutputTab[anOutputPos-aWriteOffset]
+				anOutputPos++
+				anAlreadyWritten++
+			}
+		}
+	}
+
+	return nil
+}
+
+func (state *inflaterState) readWriteSize(aCode uint16, aWriteSizeConstAdd uint32) (uint32, error) {
+	quotient := aCode / 4
+	remainder := aCode % 4
+
+	var aWriteSize uint32
+	if quotient == 0 {
+		aWriteSize = uint32(aCode)
+	} else if quotient < 7 {
+		aWriteSize = (1 << (quotient - 1)) * (4 + uint32(remainder))
+	} else if aCode == copySizeLongCode {
+		aWriteSize = 0xFF
+	} else {
+		return 0, fmt.Errorf("invalid write size code: %v", aCode)
+	}
+
+	if quotient > 1 && aCode != copySizeLongCode {
+		aWriteSizeAddBits := uint8(quotient - 1)
+		if err := state.needBits(aWriteSizeAddBits); err != nil {
+			return 0, err
+		}
+		aWriteSize |= state.readBits(aWriteSizeAddBits)
+		if err := state.dropBits(aWriteSizeAddBits); err != nil {
+			return 0, err
+		}
+	}
+
+	return aWriteSize + aWriteSizeConstAdd, nil
+}
+
+func (state *inflaterState) readWriteOffset(copyTree huffman.HuffmanTree) (uint32, error) {
+	aCode, err := state.readCode(copyTree)
+	if err != nil {
+		return 0, err
+	}
+
+	quotient := aCode / 2
+	remainder := aCode % 2
+
+	var aWriteOffset uint32
+	if quotient == 0 {
+		aWriteOffset = uint32(aCode)
+	} else if quotient < 17 {
+		aWriteOffset = (1 << (quotient - 1)) * (2 + uint32(remainder))
+	} else {
+		return 0, fmt.Errorf("invalid write offset code: %v", aCode)
+	}
+
+	if quotient > 1 {
+		aWriteOffsetAddBits := uint8(quotient - 1)
+		if err := state.needBits(aWriteOffsetAddBits); err != nil {
+			return 0, err
+		}
+		aWriteOffset |= state.readBits(aWriteOffsetAddBits)
+		if err := state.dropBits(aWriteOffsetAddBits); err != nil {
+			return 0, err
+		}
+	}
+
+	return aWriteOffset + 1, nil
+}
+
+func (state *inflaterState) parseHuffmanTree() (huffman.HuffmanTree, error) {
+	if err := state.needBits(16); err != nil {
+		return nil, err
+	}
+	aNumberOfSymbols := uint16(state.readBits(16))
+	if err := state.dropBits(16); err != nil {
+		return nil, err
+	}
+
+	if aNumberOfSymbols > maxSymbols {
+		return nil, fmt.Errorf("too many symbols to decode: %v", aNumberOfSymbols)
+	}
+
+	builder := huffman.NewBuilder()
+
+	aRemainingSymbols := int32(aNumberOfSymbols) - 1
+
+	for aRemainingSymbols > -1 {
+		aCode, err := state.readCode(dictionaryTree)
+		if err != nil {
+			return nil, err
+		}
+
+		aCodeNumberOfBits := uint8(aCode & 0x1F)
+		aCodeNumberOfSymbols := int32(aCode>>5) + 1
+
+		if aCodeNumberOfBits == 0 {
+			aRemainingSymbols -= aCodeNumberOfSymbols
+			continue
+		}
+
+		for ; aCodeNumberOfSymbols > 0 && aRemainingSymbols > -1; aCodeNumberOfSymbols-- {
+			if err := builder.AddSymbol(aCodeNumberOfBits, uint16(aRemainingSymbols)); err != nil {
+				return nil, err
+			}
+			aRemainingSymbols--
+		}
+	}
+
+	return builder.Build(), nil
+}
+
+//
+// helper functions
+//
+
+func (state *inflaterState) needBits(bits uint8) error {
+	if bits > 32 {
+		return fmt.Errorf("tried to need more than 32 bits")
+	}
+
+	if state.bits < bits {
+		if err := state.pullByte(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (state *inflaterState) pullByte() error {
+	if state.bits >= 32 {
+		return fmt.Errorf("tried to pull a value while we still have 32 bits available")
+	}
+
+	// every 0x4000th word is a checksum
+	if (state.inputPos+1)%(0x4000) == 0 {
+		state.inputPos++
+	}
+
+	var value uint32
+
+	if state.inputPos >= state.inputSize {
+		if state.isEmpty {
+			return fmt.Errorf("reached end of input while trying to fetch a new byte")
+		}
+
+		state.isEmpty = true
+	} else {
+		value = state.input[state.inputPos]
+	}
+
+	if state.bits == 0 {
+		state.head = value
+		state.buffer = 0
+	} else {
+		state.head = state.head | (value >> state.bits)
+		state.buffer = value << (32 - state.bits)
+	}
+
+	state.bits += 32
+	state.inputPos++
+
+	return nil
+}
+
+func (state *inflaterState) dropBits(bits uint8) error {
+	if bits > 32 {
+		return fmt.Errorf("tried to drop more than 32 bits")
+	}
+
+	if bits > state.bits {
+		return fmt.Errorf("tried to drop more bits than we have")
+	}
+
+	if bits == 32 {
+		state.head = state.buffer
+		state.buffer = 0
+	} else {
+		state.head <<= bits
+		state.head |= (state.buffer) >> (32 - bits)
+		state.buffer <<= bits
+	}
+
+	state.bits -= bits
+
+	return nil
+}
+
+func (state *inflaterState) readBits(bits uint8) uint32 {
+	return state.head >> (32 - bits)
+}
+
+func (state *inflaterState) readCode(tree huffman.HuffmanTree) (uint16, error) {
+	if tree.IsEmpty() {
+		return 0, fmt.Errorf("huffmanTree not initialized")
+	}
+
+	if err := state.needBits(32); err != nil {
+		return 0, err
+	}
+
+	hash := state.readBits(uint8(huffman.MaxNbBitsHash))
+
+	if tree.GetSymbolValueHash(hash) != 0xFFFF {
+		if err := state.dropBits(tree.GetCodeBitsHash(hash)); err != nil {
+			return 0, err
+		}
+
+		return tree.GetSymbolValueHash(hash), nil
+	}
+
+	var anIndex uint32
+	tmp := state.readBits(32)
+	for tmp < tree.GetCodeComp(anIndex) {
+		anIndex++
+	}
+
+	aNbBits := tree.GetCodeBits(anIndex)
+	symbol := uint32(tree.GetSymbolValueOffset(anIndex)) -
+		((tmp - tree.GetCodeComp(anIndex)) >> (32 - aNbBits))
+
+	ioCode := tree.GetSymbolValue(symbol)
+	if err := state.dropBits(aNbBits); err != nil {
+		return 0, err
+	}
+
+	return ioCode, nil
+}
@@ -0,0 +1,155 @@
+package datInflater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/ptolstoi/gw2imageserver/internal/huffman"
+)
+
+type huffmanCode struct {
+	code uint32
+	bits uint8
+}
+
+// codesOf finds the code of every symbol of tree by decoding all 16 bit
+// prefixes.
+func codesOf(t *testing.T, tree huffman.HuffmanTree) map[uint16]huffmanCode {
+	codes := map[uint16]huffmanCode{}
+
+	for prefix := uint32(0); prefix < 1<<16; prefix++ {
+		state := newInflaterState(&[]uint32{prefix << 16, 0})
+
+		symbol, err := state.readCode(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bits := 32 - state.bits
+		if _, ok := codes[symbol]; !ok {
+			codes[symbol] = huffmanCode{code: prefix >> (16 - bits), bits: bits}
+		}
+	}
+
+	return codes
+}
+
+// bitWriter writes most significant bits first into little endian words,
+// the order inflaterState reads them in.
+type bitWriter struct {
+	words []uint32
+	bits  uint
+}
+
+func (writer *bitWriter) write(value uint32, bits uint8) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		if writer.bits%32 == 0 {
+			writer.words = append(writer.words, 0)
+		}
+		if value&(1<<uint(i)) != 0 {
+			writer.words[len(writer.words)-1] |= 1 << (31 - writer.bits%32)
+		}
+		writer.bits++
+	}
+}
+
+func (writer *bitWriter) writeCode(codes map[uint16]huffmanCode, symbol uint16) {
+	code := codes[symbol]
+	writer.write(code.code, code.bits)
+}
+
+func (writer *bitWriter) bytes() []byte {
+	buffer := new(bytes.Buffer)
+	_ = binary.Write(buffer, binary.LittleEndian, append(writer.words, 0, 0))
+	return buffer.Bytes()
+}
+
+// compress writes literals and one copy of copySize times the byte before
+// it, using a symbol tree with 9 bit codes for 0x000-0x100 and a copy tree
+// with a single 1 bit code for offset 1.
+func compress(t *testing.T, literals []byte, copySize uint8) ([]byte, int) {
+	dictionary := codesOf(t, dictionaryTree)
+
+	symbols := huffman.NewBuilder()
+	for symbol := 0x100; symbol >= 0; symbol-- {
+		if err := symbols.AddSymbol(9, uint16(symbol)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symbolCodes := codesOf(t, symbols.Build())
+
+	writer := bitWriter{}
+	writer.write(0, 32)
+	writer.write(uint32(len(literals))+uint32(copySize), 32)
+
+	writer.write(0, 4)
+	writer.write(uint32(copySize-1), 4) // every copy is copySize bytes
+
+	writer.write(0x101, 16)
+	for i := 0; i < 32; i++ {
+		writer.writeCode(dictionary, 7<<5|9) // 8 symbols of 9 bits
+	}
+	writer.writeCode(dictionary, 9) // the last one
+
+	writer.write(1, 16)
+	writer.writeCode(dictionary, 1) // one symbol of 1 bit
+
+	writer.write(0, 4)
+
+	for _, literal := range literals {
+		writer.writeCode(symbolCodes, uint16(literal))
+	}
+	if copySize > 0 {
+		writer.writeCode(symbolCodes, 0x100)
+		writer.write(0, 1) // offset 1
+	}
+
+	return writer.bytes(), len(literals) + int(copySize)
+}
+
+func TestInflate(t *testing.T) {
+	compressed, size := compress(t, []byte("ab"), 3)
+
+	output, err := Inflate(compressed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "abbbb" || len(output) != size {
+		t.Fatalf("got %q", output)
+	}
+
+	if announced, err := OutputSize(compressed); err != nil || announced != uint32(size) {
+		t.Fatalf("OutputSize = %v, %v", announced, err)
+	}
+}
+
+func TestInflateRejectsOversizedOutput(t *testing.T) {
+	compressed, _ := compress(t, []byte("ab"), 3)
+
+	if _, err := Inflate(compressed, 4); err == nil {
+		t.Fatal("want an error for output beyond maxOutputSize")
+	}
+
+	binary.LittleEndian.PutUint32(compressed[4:8], 0xFFFFFFFF)
+	if _, err := Inflate(compressed, 0); err == nil {
+		t.Fatal("want an error for output beyond MaxOutputSize")
+	}
+}
+
+func TestInflateGarbage(t *testing.T) {
+	if _, err := Inflate([]byte{1, 2, 3}, 0); err == nil {
+		t.Fatal("want an error for truncated data")
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 8+random.Intn(256))
+		random.Read(data)
+		binary.LittleEndian.PutUint32(data[4:8], uint32(random.Intn(4096)))
+
+		// must neither panic nor hang
+		_, _ = Inflate(data, 0)
+	}
+}
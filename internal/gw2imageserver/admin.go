@@ -0,0 +1,659 @@
+package gw2imageserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ptolstoi/neversorrow"
+	"github.com/ptolstoi/neversorrow/errors"
+)
+
+type AdminConfig struct {
+	// Token has to be sent as "Authorization: Bearer <token>" to use the
+	// admin endpoints. Without a token they are disabled.
+	Token string
+}
+
+func (app *app) initAdminHTTP() {
+	app.AddRoute("GET", "/v1/admin/faults", app.serveFaults)
+	app.AddRoute("PUT", "/v1/admin/faults", app.updateFaults)
+	app.AddRoute("POST", "/v1/admin/signatures", app.importSignatures)
+
+	app.initCacheAdminHTTP()
+}
+
+func (app *app) isAdmin(ctx neversorrow.Context) bool {
+	if app.adminToken == "" {
+		return false
+	}
+
+	authorization := ctx.Request().Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.adminToken)) == 1
+}
+
+func (app *app) requireAdmin(ctx neversorrow.Context) bool {
+	if app.adminToken == "" {
+		ctx.Error(errors.NewWithCode("admin endpoints are disabled", http.StatusForbidden))
+		return false
+	}
+
+	if !app.isAdmin(ctx) {
+		ctx.Error(errors.NewWithCode("unauthorized", http.StatusUnauthorized))
+		return false
+	}
+
+	return true
+}
+
+func (app *app) serveFaults(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	writeJSON(ctx, app.upstream.faults.getConfig())
+}
+
+func (app *app) updateFaults(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	config := app.upstream.faults.getConfig()
+	if !readJSON(ctx, &config) {
+		return
+	}
+
+	if err := app.upstream.faults.setConfig(config); err != nil {
+		ctx.Error(errors.NewWithCode(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	writeJSON(ctx, app.upstream.faults.getConfig())
+}
+
+type signatureView struct {
+	Signature string `json:"signature"`
+	File      string `json:"file"`
+}
+
+type signatureImport struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// importSignatures takes a list of signatures and the files they belong to,
+// as found in render URLs of the official API.
+func (app *app) importSignatures(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	var signatures []signatureView
+	if !readJSON(ctx, &signatures) {
+		return
+	}
+
+	result, err := app.saveSignatures(signatures)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("import failed: %v", err), http.StatusBadRequest))
+		return
+	}
+
+	writeJSON(ctx, result)
+}
+
+// saveSignatures checks every signature before saving any of them.
+func (app *app) saveSignatures(signatures []signatureView) (signatureImport, error) {
+	result := signatureImport{}
+
+	for i := range signatures {
+		signatures[i].Signature = strings.ToUpper(signatures[i].Signature)
+		if !isSignature(signatures[i].Signature) || !isFileID(signatures[i].File) {
+			return result, fmt.Errorf("invalid signature %q for file %q", signatures[i].Signature, signatures[i].File)
+		}
+	}
+
+	for _, signature := range signatures {
+		saved, err := app.saveSignature(signature.Signature, signature.File)
+		if err != nil {
+			return result, err
+		} else if saved {
+			result.Imported++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	return result, nil
+}
+
+type cacheEntryView struct {
+	File     string `json:"file"`
+	FileType string `json:"fileType"`
+	Size     int    `json:"size"`
+
+	Hash         string     `json:"sha256,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	LastAccess   *time.Time `json:"lastAccess,omitempty"`
+	Hits         int64      `json:"hits"`
+
+	ETag             string `json:"etag,omitempty"`
+	UpstreamModified string `json:"upstreamModified,omitempty"`
+
+	derivation
+}
+
+type cacheEntryList struct {
+	Total   int              `json:"total"`
+	Offset  int              `json:"offset"`
+	Entries []cacheEntryView `json:"entries"`
+}
+
+type cacheTypeStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type cacheStats struct {
+	Entries int                       `json:"entries"`
+	Bytes   int64                     `json:"bytes"`
+	ByType  map[string]cacheTypeStats `json:"byType"`
+	Memory  memoryCacheStatus         `json:"memory"`
+}
+
+func (app *app) initCacheAdminHTTP() {
+	app.AddRoute("GET", "/v1/admin/cache/stats", app.serveCacheStats)
+	app.AddRoute("GET", "/v1/admin/cache/entries", app.serveCacheEntries)
+	app.AddRoute("GET", "/v1/admin/cache/entries/:file", app.serveCacheFile)
+	app.AddRoute("GET", "/v1/admin/cache/entries/:file/:fileType", app.serveCacheEntry)
+	app.AddRoute("DELETE", "/v1/admin/cache/entries/:file", app.deleteCacheFile)
+	app.AddRoute("DELETE", "/v1/admin/cache/entries/:file/:fileType", app.deleteCacheEntry)
+	app.AddRoute("DELETE", "/v1/admin/cache/types/:fileType", app.deleteCacheType)
+	app.AddRoute("POST", "/v1/admin/cache/entries/:file/purge", app.purgeCacheFile)
+	app.AddRoute("POST", "/v1/admin/cache/entries/:file/refetch", app.refetchCacheFile)
+	app.AddRoute("GET", "/v1/admin/cache/bundle", app.serveCacheBundle)
+	app.AddRoute("POST", "/v1/admin/cache/bundle", app.importCacheBundle)
+}
+
+func entryView(entry storageEntry) cacheEntryView {
+	view := cacheEntryView{
+		File:     entry.file,
+		FileType: entry.fileType,
+		Size:     entry.size,
+		Hits:     entry.hits,
+	}
+	if !entry.lastAccess.IsZero() {
+		lastAccess := entry.lastAccess.UTC()
+		view.LastAccess = &lastAccess
+	}
+
+	return view
+}
+
+func fileView(file *file) cacheEntryView {
+	lastModified := file.lastModified.UTC()
+
+	return cacheEntryView{
+		File:     file.file,
+		FileType: file.fileType,
+		Size:     file.size,
+
+		Hash:         file.hash,
+		LastModified: &lastModified,
+
+		ETag:             file.etag,
+		UpstreamModified: file.upstreamModified,
+
+		derivation: file.derivation,
+	}
+}
+
+var errNoListing = errors.NewWithCode("the cache backend can't list its entries", http.StatusNotImplemented)
+
+// entryQuery filters, sorts and pages a listing of the cache. A limit below 1
+// returns all matching entries.
+type entryQuery struct {
+	file       string
+	filePrefix string
+	fileType   string
+
+	sort   string
+	offset int
+	limit  int
+}
+
+// storagePager is implemented by backends that answer entry queries and
+// stats themselves, instead of listing every entry.
+type storagePager interface {
+	queryEntries(query entryQuery) ([]storageEntry, int, error)
+	typeStats() (map[string]cacheTypeStats, error)
+}
+
+func (query entryQuery) matches(entry storageEntry) bool {
+	return (query.file == "" || entry.file == query.file) &&
+		(query.fileType == "" || entry.fileType == query.fileType) &&
+		strings.HasPrefix(entry.file, query.filePrefix)
+}
+
+func entryOrder(sortBy string) (func(a, b storageEntry) bool, error) {
+	switch sortBy {
+	case "", "file":
+		return func(a, b storageEntry) bool {
+			if a.file != b.file {
+				return a.file < b.file
+			}
+			return a.fileType < b.fileType
+		}, nil
+	case "size":
+		return func(a, b storageEntry) bool { return a.size > b.size }, nil
+	case "hits":
+		return func(a, b storageEntry) bool { return a.hits > b.hits }, nil
+	case "lastAccess":
+		return func(a, b storageEntry) bool { return a.lastAccess.After(b.lastAccess) }, nil
+	}
+
+	return nil, fmt.Errorf("invalid sort: %v", sortBy)
+}
+
+// queryEntries returns a page of the matching entries and how many match in
+// total. Backends that can't page are listed completely.
+func (app *app) queryEntries(query entryQuery) ([]storageEntry, int, error) {
+	less, err := entryOrder(query.sort)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if pager, ok := app.storage.(storagePager); ok {
+		return pager.queryEntries(query)
+	}
+
+	lister, ok := app.storage.(storageLister)
+	if !ok {
+		return nil, 0, errNoListing
+	}
+
+	entries, err := lister.entries()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if query.matches(entry) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return less(filtered[i], filtered[j])
+	})
+
+	total := len(filtered)
+	if query.offset >= total {
+		return nil, total, nil
+	}
+	filtered = filtered[query.offset:]
+	if query.limit > 0 && query.limit < len(filtered) {
+		filtered = filtered[:query.limit]
+	}
+
+	return filtered, total, nil
+}
+
+func (app *app) cacheStats() (*cacheStats, error) {
+	stats := cacheStats{
+		ByType: map[string]cacheTypeStats{},
+		Memory: app.memory.status(),
+	}
+
+	if pager, ok := app.storage.(storagePager); ok {
+		byType, err := pager.typeStats()
+		if err != nil {
+			return nil, err
+		}
+		stats.ByType = byType
+	} else if lister, ok := app.storage.(storageLister); ok {
+		entries, err := lister.entries()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			typeStats := stats.ByType[entry.fileType]
+			typeStats.Entries++
+			typeStats.Bytes += int64(entry.size)
+			stats.ByType[entry.fileType] = typeStats
+		}
+	} else {
+		return nil, errNoListing
+	}
+
+	for _, typeStats := range stats.ByType {
+		stats.Entries += typeStats.Entries
+		stats.Bytes += typeStats.Bytes
+	}
+
+	return &stats, nil
+}
+
+// listingFailed answers a failed listing, 501 if the backend can't list.
+func listingFailed(ctx neversorrow.Context, err error) {
+	if err == errNoListing {
+		ctx.Error(err)
+		return
+	}
+
+	ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't list the cache: %v", err), http.StatusInternalServerError))
+}
+
+func queryInt(ctx neversorrow.Context, key string, fallback int) (int, bool) {
+	value := ctx.Request().URL.Query().Get(key)
+	if value == "" {
+		return fallback, true
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("invalid %v: %v", key, value), http.StatusBadRequest))
+		return 0, false
+	}
+
+	return parsed, true
+}
+
+func (app *app) serveCacheStats(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	stats, err := app.cacheStats()
+	if err != nil {
+		listingFailed(ctx, err)
+		return
+	}
+
+	writeJSON(ctx, stats)
+}
+
+// serveCacheEntries lists entries, optionally filtered by ?fileType= and a
+// ?file= prefix, sorted by ?sort=file|size|hits|lastAccess and paged with
+// ?offset= and ?limit=.
+func (app *app) serveCacheEntries(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	query := ctx.Request().URL.Query()
+
+	offset, ok := queryInt(ctx, "offset", 0)
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(ctx, "limit", 100)
+	if !ok {
+		return
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 1000
+	}
+
+	if _, err := entryOrder(query.Get("sort")); err != nil {
+		ctx.Error(errors.NewWithCode(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	entries, total, err := app.queryEntries(entryQuery{
+		filePrefix: query.Get("file"),
+		fileType:   query.Get("fileType"),
+
+		sort:   query.Get("sort"),
+		offset: offset,
+		limit:  limit,
+	})
+	if err != nil {
+		listingFailed(ctx, err)
+		return
+	}
+
+	list := cacheEntryList{
+		Total:   total,
+		Offset:  offset,
+		Entries: []cacheEntryView{},
+	}
+	for _, entry := range entries {
+		list.Entries = append(list.Entries, entryView(entry))
+	}
+
+	writeJSON(ctx, list)
+}
+
+// serveCacheFile lists every entry of one file ID.
+func (app *app) serveCacheFile(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	entries, _, err := app.queryEntries(entryQuery{file: ctx.Params()["file"]})
+	if err != nil {
+		listingFailed(ctx, err)
+		return
+	}
+
+	views := []cacheEntryView{}
+	for _, entry := range entries {
+		views = append(views, entryView(entry))
+	}
+
+	if len(views) == 0 {
+		ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+		return
+	}
+
+	writeJSON(ctx, views)
+}
+
+func (app *app) serveCacheEntry(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	file, err := app.getFileMetadataFromCache(ctx.Params()["file"], ctx.Params()["fileType"])
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("error during lookup: %v", err), http.StatusInternalServerError))
+		return
+	} else if file == nil {
+		ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+		return
+	}
+
+	writeJSON(ctx, fileView(file))
+}
+
+func (app *app) deleteCacheFile(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	fileID := ctx.Params()["file"]
+
+	err := app.purgeFile(fileID)
+	if err == nil {
+		err = app.deleteFileFromCache(fileID, "uncompressed")
+	}
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't delete %v: %v", fileID, err), http.StatusInternalServerError))
+		return
+	}
+
+	ctx.ResponseWriter().WriteHeader(http.StatusNoContent)
+}
+
+func (app *app) deleteCacheEntry(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	fileID, fileType := ctx.Params()["file"], ctx.Params()["fileType"]
+
+	if err := app.deleteFileFromCache(fileID, fileType); err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't delete %v %v: %v", fileID, fileType, err), http.StatusInternalServerError))
+		return
+	}
+
+	ctx.ResponseWriter().WriteHeader(http.StatusNoContent)
+}
+
+func (app *app) deleteCacheType(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	entries, _, err := app.queryEntries(entryQuery{fileType: ctx.Params()["fileType"]})
+	if err != nil {
+		listingFailed(ctx, err)
+		return
+	}
+
+	deleted := 0
+
+	for _, entry := range entries {
+		if err := app.deleteFileFromCache(entry.file, entry.fileType); err != nil {
+			ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't delete %v %v: %v", entry.file, entry.fileType, err), http.StatusInternalServerError))
+			return
+		}
+		deleted++
+	}
+
+	writeJSON(ctx, map[string]int{"deleted": deleted})
+}
+
+// purgeCacheFile drops the derived variants of a file and its revisions,
+// they are rendered again from the raw files on the next request.
+func (app *app) purgeCacheFile(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	fileID := ctx.Params()["file"]
+
+	if err := app.purgeFile(fileID); err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't purge %v: %v", fileID, err), http.StatusInternalServerError))
+		return
+	}
+
+	ctx.ResponseWriter().WriteHeader(http.StatusNoContent)
+}
+
+// purgeFile drops the variants of fileID and of its revisions.
+func (app *app) purgeFile(fileID string) error {
+	if err := app.deleteDerivedFilesFromCache(fileID); err != nil {
+		return err
+	}
+
+	return app.deletePinnedFilesFromCache(fileID)
+}
+
+// refetchCacheFile fetches the raw file again, unconditionally, and drops
+// its derived variants and those of its revisions.
+func (app *app) refetchCacheFile(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	fileID := ctx.Params()["file"]
+
+	file, err := app.inflight.do(fileID, "uncompressed", func() (*file, error) {
+		fetched, err := app.revalidateFile(fileID, nil, priorityInteractive)
+		if err != nil || fetched == nil {
+			return nil, err
+		}
+
+		return fetched, app.purgeFile(fileID)
+	})
+	if err != nil {
+		statusCode := http.StatusBadGateway
+		if err == errBreakerOpen || err == errUpstreamBusy {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("couldn't refetch %v: %v", fileID, err), statusCode))
+		return
+	} else if file == nil {
+		ctx.Error(errors.NewWithCode("file not found upstream", http.StatusNotFound))
+		return
+	}
+
+	file.size = len(file.content)
+	writeJSON(ctx, fileView(file))
+}
+
+func (app *app) bundleFilter(ctx neversorrow.Context) (BundleFilter, bool) {
+	filter := BundleFilter{
+		FileTypes: ctx.Request().URL.Query()["fileType"],
+	}
+
+	minID, ok := queryInt(ctx, "minId", 0)
+	if !ok {
+		return filter, false
+	}
+	maxID, ok := queryInt(ctx, "maxId", 0)
+	if !ok {
+		return filter, false
+	}
+
+	filter.MinID, filter.MaxID = uint64(minID), uint64(maxID)
+
+	return filter, true
+}
+
+// serveCacheBundle streams a bundle of the cache, filtered by ?minId=,
+// ?maxId= and ?fileType=.
+func (app *app) serveCacheBundle(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	filter, ok := app.bundleFilter(ctx)
+	if !ok {
+		return
+	}
+	if _, ok := app.storage.(storageLister); !ok {
+		ctx.Error(errNoListing)
+		return
+	}
+
+	resp := ctx.ResponseWriter()
+	resp.Header().Set(contentType, "application/x-tar")
+	resp.Header().Set("Content-Disposition", `attachment; filename="gw2imageserver-cache.tar"`)
+
+	// the status is sent already, errors can only cut the stream short
+	if _, err := app.exportBundle(resp, filter); err != nil {
+		log.Printf("[serveCacheBundle] %v", err)
+	}
+}
+
+func (app *app) importCacheBundle(ctx neversorrow.Context) {
+	if !app.requireAdmin(ctx) {
+		return
+	}
+
+	result, err := app.importBundle(ctx.Request().Body)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("import failed: %v", err), http.StatusBadRequest))
+		return
+	}
+
+	writeJSON(ctx, result)
+}
@@ -0,0 +1,102 @@
+package gw2imageserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func saveTestEntries(t *testing.T, app *app) {
+	t.Helper()
+
+	for _, entry := range []struct {
+		fileID, fileType string
+		size             int
+	}{
+		{"1", "uncompressed", 10}, {"1", "png", 30}, {"2", "png", 20}, {"10", "jpg", 5},
+	} {
+		if err := app.saveFileToCache(testFile(entry.fileID, entry.fileType, make([]byte, entry.size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func entryNames(entries []storageEntry) []string {
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.file+" "+entry.fileType)
+	}
+
+	return names
+}
+
+func TestQueryEntries(t *testing.T) {
+	fake := newFakeS3(t)
+
+	for _, backend := range []string{storageBackendSQLite, storageBackendFilesystem, storageBackendS3} {
+		t.Run(backend, func(t *testing.T) {
+			app := newTestApp(t, func(config *Config) {
+				config.Cache.Backend = backend
+				config.Cache.S3 = fake.config
+				config.Cache.S3.Prefix = backend + "/"
+			})
+			saveTestEntries(t, app)
+
+			for _, test := range []struct {
+				query entryQuery
+				want  []string
+				total int
+			}{
+				{entryQuery{}, []string{"1 png", "1 uncompressed", "10 jpg", "2 png"}, 4},
+				{entryQuery{sort: "size", limit: 2}, []string{"1 png", "2 png"}, 4},
+				{entryQuery{sort: "size", offset: 3}, []string{"10 jpg"}, 4},
+				{entryQuery{filePrefix: "1", limit: 2}, []string{"1 png", "1 uncompressed"}, 3},
+				{entryQuery{file: "1"}, []string{"1 png", "1 uncompressed"}, 2},
+				{entryQuery{fileType: "png", offset: 1}, []string{"2 png"}, 2},
+				{entryQuery{offset: 10}, []string{}, 4},
+			} {
+				entries, total, err := app.queryEntries(test.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if names := entryNames(entries); !reflect.DeepEqual(names, test.want) || total != test.total {
+					t.Errorf("%+v: got %v of %v, want %v of %v", test.query, names, total, test.want, test.total)
+				}
+			}
+
+			stats, err := app.cacheStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Entries != 4 || stats.Bytes != 65 || stats.ByType["png"] != (cacheTypeStats{Entries: 2, Bytes: 50}) {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestPurgeDropsPinnedVariants(t *testing.T) {
+	app := newTestApp(t, nil)
+
+	raw := testFile("1", "uncompressed", testTexture(0xf800f800))
+	if err := app.saveFileToCache(raw); err != nil {
+		t.Fatal(err)
+	}
+	app.recordRevision(raw, raw.lastModified)
+	for _, fileID := range []string{"1", revisionFileID("1", 1)} {
+		if err := app.saveFileToCache(testFile(fileID, "png", []byte(fileID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := app.purgeFile("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := app.queryEntries(entryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"1 uncompressed"}) {
+		t.Fatalf("got entries %v after purging", names)
+	}
+}
@@ -1,46 +1,131 @@
 package gw2imageserver
 
 import (
-	"database/sql"
-	"net/http"
-	"time"
+	"log"
+	"sync"
 
+	"github.com/ptolstoi/gw2imageserver/internal/datFile"
 	"github.com/ptolstoi/neversorrow"
 )
 
 type app struct {
 	neversorrow.App
 
-	db *sql.DB
+	db      *sqliteDB
+	storage storage
+	memory  *memoryCache
 
-	httpClient *http.Client
+	accesses   *accessTracker
+	refreshing sync.Map
+	background sync.WaitGroup
+
+	// retryRefresh holds when entries whose refresh failed may be refreshed
+	// again, by coalesceKey
+	retryRefresh sync.Map
+
+	upstream *upstreamClient
+	archive  *datFile.Archive
+	sources  []textureSource
+
+	inflight *coalescer
+	manifest *manifestState
+
+	adminToken  string
+	cacheConfig CacheConfig
+	cachePolicy cachePolicy
+
+	done chan struct{}
+}
+
+type Config struct {
+	neversorrow.Config
+
+	Upstream UpstreamConfig
+	Manifest ManifestConfig
+	Archive  ArchiveConfig
+	Admin    AdminConfig
+	Cache    CacheConfig
 }
 
 type App interface {
 	RunUntilSignal() error
 }
 
-func NewApp(config neversorrow.Config) (App, error) {
-	neversorrowApp, err := neversorrow.New(config)
+func NewApp(config Config) (App, error) {
+	neversorrowApp, err := neversorrow.New(config.Config)
 	if err != nil {
 		return nil, err
 	}
 
-	app := app{
-		App: neversorrowApp,
-
-		httpClient: &http.Client{
-			Timeout: 15 * time.Second,
-		},
+	app, err := newApp(config)
+	if err != nil {
+		return nil, err
 	}
+	app.App = neversorrowApp
 
-	if err := app.initDB(); err != nil {
+	if err := app.initDB(config.Cache.SQLite); err != nil {
+		return nil, err
+	}
+	if err := app.initStorage(config.Cache); err != nil {
 		return nil, err
 	}
+	app.initEvictor(config.Cache)
+	app.initScrubber(config.Cache)
 	app.initHTTP()
+	if !config.Upstream.Disabled {
+		app.initManifest(config.Manifest)
+	}
 
 	app.OnClose(app.close)
 
+	return app, nil
+}
+
+// newApp sets up everything needed to fetch and decode textures, without
+// the HTTP server and the cache.
+func newApp(config Config) (*app, error) {
+	upstream, err := newUpstreamClient(config.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := parseCachePolicy(config.Cache.Policy)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEvictPolicy(config.Cache.EvictPolicy); err != nil {
+		return nil, err
+	}
+
+	app := app{
+		upstream: upstream,
+
+		inflight: newCoalescer(),
+		manifest: &manifestState{},
+
+		adminToken:  config.Admin.Token,
+		cacheConfig: config.Cache,
+		cachePolicy: policy,
+
+		memory:   newMemoryCache(config.Cache.MemoryBytes),
+		accesses: newAccessTracker(),
+
+		done: make(chan struct{}),
+	}
+
+	if config.Archive.Path != "" {
+		archive, err := datFile.Open(config.Archive.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		app.archive = archive
+		app.sources = append(app.sources, &archiveSource{archive: archive})
+	}
+	if !config.Upstream.Disabled {
+		app.sources = append(app.sources, &upstreamSource{client: app.upstream})
+	}
+
 	return &app, nil
 }
 
@@ -50,5 +135,16 @@ func (app *app) RunUntilSignal() error {
 }
 
 func (app *app) close(neversorrow.App) {
+	close(app.done)
+	app.background.Wait()
 	app.closeDB()
+	app.closeArchive()
+}
+
+func (app *app) closeArchive() {
+	if app.archive != nil {
+		if err := app.archive.Close(); err != nil {
+			log.Printf("[close] %v", err)
+		}
+	}
 }
@@ -0,0 +1,138 @@
+package gw2imageserver
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestApp opens a cache in a temporary directory, without HTTP and with
+// upstream disabled unless configure says otherwise.
+func newTestApp(t testing.TB, configure func(config *Config)) *app {
+	directory := t.TempDir()
+
+	config := Config{
+		Upstream: UpstreamConfig{
+			Disabled:      true,
+			Timeout:       5 * time.Second,
+			MaxAttempts:   1,
+			MaxConcurrent: 4,
+		},
+		Cache: CacheConfig{
+			SQLite: SQLiteConfig{
+				Path:        filepath.Join(directory, "cache.db"),
+				Readers:     4,
+				BusyTimeout: 5 * time.Second,
+			},
+			Directory:  filepath.Join(directory, "cache"),
+			DefaultTTL: time.Hour,
+			MaxStale:   time.Hour,
+		},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	app, err := openCache(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		close(app.done)
+		app.background.Wait()
+		app.closeDB()
+	})
+
+	return app
+}
+
+// testTexture returns a 4x4 uncompressed DXT1 texture filled with color, a
+// pair of RGB565 colors.
+func testTexture(color uint32) []byte {
+	words := []uint32{0x58455441, 0x31545844, 4 | 4<<16, 0, 0, color, 0}
+
+	data := make([]byte, 4*len(words))
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(data[4*i:], word)
+	}
+
+	return data
+}
+
+// testUpstream serves textures under /file/{file} with their hash as ETag and
+// counts the requests it answered.
+type testUpstream struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	files    map[string][]byte
+	requests int
+	notMods  int
+}
+
+func newTestUpstream(t testing.TB) *testUpstream {
+	upstream := &testUpstream{
+		files: map[string][]byte{},
+	}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(upstream.serve))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func (upstream *testUpstream) set(fileID string, content []byte) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	upstream.files[fileID] = content
+}
+
+func (upstream *testUpstream) remove(fileID string) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	delete(upstream.files, fileID)
+}
+
+func (upstream *testUpstream) counts() (int, int) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	return upstream.requests, upstream.notMods
+}
+
+func (upstream *testUpstream) serve(writer http.ResponseWriter, request *http.Request) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	upstream.requests++
+
+	content, ok := upstream.files[strings.TrimPrefix(request.URL.Path, "/file/")]
+	if !ok {
+		http.NotFound(writer, request)
+		return
+	}
+
+	etag := `"` + contentHash(content) + `"`
+	if request.Header.Get("If-None-Match") == etag {
+		upstream.notMods++
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writer.Header().Set("ETag", etag)
+	_, _ = writer.Write(content)
+}
+
+// useUpstream points config at upstream.
+func useUpstream(config *Config, upstream *testUpstream) {
+	config.Upstream.Disabled = false
+	config.Upstream.Mirrors = []string{upstream.URL}
+	config.Upstream.FilePath = "/file/{file}"
+}
@@ -0,0 +1,170 @@
+package gw2imageserver
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BenchConfig describes a load benchmark of the SQLite cache. It runs
+// against a scratch database, never against the configured cache.db.
+type BenchConfig struct {
+	Writers  int
+	Readers  int
+	Files    int
+	Size     int
+	Duration time.Duration
+}
+
+type BenchResult struct {
+	Writes BenchStats
+	Reads  BenchStats
+}
+
+type BenchStats struct {
+	Operations int
+	Errors     int
+	PerSecond  float64
+	P50        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+func (stats BenchStats) String() string {
+	return fmt.Sprintf("%8d ops %10.1f ops/s  p50=%-10v p99=%-10v max=%-10v errors=%v",
+		stats.Operations, stats.PerSecond, stats.P50, stats.P99, stats.Max, stats.Errors)
+}
+
+type benchRecorder struct {
+	lock      sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (recorder *benchRecorder) record(start time.Time, err error) {
+	latency := time.Since(start)
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	recorder.latencies = append(recorder.latencies, latency)
+	if err != nil {
+		recorder.errors++
+	}
+}
+
+func (recorder *benchRecorder) stats(elapsed time.Duration) BenchStats {
+	latencies := recorder.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	stats := BenchStats{
+		Operations: len(latencies),
+		Errors:     recorder.errors,
+		PerSecond:  float64(len(latencies)) / elapsed.Seconds(),
+	}
+	if len(latencies) > 0 {
+		stats.P50 = latencies[len(latencies)/2]
+		stats.P99 = latencies[len(latencies)*99/100]
+		stats.Max = latencies[len(latencies)-1]
+	}
+
+	return stats
+}
+
+// Benchmark saves and reads files concurrently through the SQLite storage.
+func Benchmark(config Config, bench BenchConfig) (*BenchResult, error) {
+	if bench.Files < 1 {
+		return nil, fmt.Errorf("need at least one file")
+	}
+
+	directory, err := ioutil.TempDir("", "gw2imageserver-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.RemoveAll(directory) }()
+
+	sqliteConfig := config.Cache.SQLite
+	sqliteConfig.Path = filepath.Join(directory, "cache.db")
+
+	db, err := openSQLite(sqliteConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.close() }()
+
+	storage, err := newSQLiteStorage(db)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, bench.Size)
+	if _, err := rand.Read(content); err != nil {
+		return nil, err
+	}
+
+	benchFile := func(i int) *file {
+		// vary the content so saves don't all share one blob
+		content := append([]byte(fmt.Sprintf("%08d", i)), content...)
+
+		return &file{
+			file:         fmt.Sprint(i),
+			fileType:     "uncompressed",
+			content:      content,
+			size:         len(content),
+			hash:         contentHash(content),
+			lastModified: time.Now().UTC(),
+		}
+	}
+
+	// seed all files so reads hit from the start
+	for i := 0; i < bench.Files; i++ {
+		if err := storage.save(benchFile(i)); err != nil {
+			return nil, err
+		}
+	}
+
+	writes, reads := benchRecorder{}, benchRecorder{}
+	deadline := time.Now().Add(bench.Duration)
+	wait := sync.WaitGroup{}
+
+	worker := func(worker int, recorder *benchRecorder, operation func(i int) error) {
+		defer wait.Done()
+
+		for i := worker; time.Now().Before(deadline); i++ {
+			start := time.Now()
+			recorder.record(start, operation(i%bench.Files))
+		}
+	}
+
+	started := time.Now()
+
+	for i := 0; i < bench.Writers; i++ {
+		wait.Add(1)
+		go worker(i, &writes, func(i int) error {
+			return storage.save(benchFile(i))
+		})
+	}
+	for i := 0; i < bench.Readers; i++ {
+		wait.Add(1)
+		go worker(i, &reads, func(i int) error {
+			file, err := storage.get(fmt.Sprint(i), "uncompressed")
+			if err == nil && file == nil {
+				err = fmt.Errorf("file %v is missing", i)
+			}
+			return err
+		})
+	}
+
+	wait.Wait()
+	elapsed := time.Since(started)
+
+	return &BenchResult{
+		Writes: writes.stats(elapsed),
+		Reads:  reads.stats(elapsed),
+	}, nil
+}
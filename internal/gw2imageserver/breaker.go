@@ -0,0 +1,127 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+var errBreakerOpen = fmt.Errorf("upstream circuit breaker is open")
+
+type circuitBreaker struct {
+	mutex sync.Mutex
+
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probeRunning        bool
+	lastError           string
+}
+
+type breakerStatus struct {
+	Name                string       `json:"name"`
+	State               breakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutiveFailures"`
+	OpenedAt            *time.Time   `json:"openedAt,omitempty"`
+	RetryAt             *time.Time   `json:"retryAt,omitempty"`
+	LastError           string       `json:"lastError,omitempty"`
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent. After the cooldown an open
+// breaker lets exactly one probe through; its outcome decides the new state.
+func (breaker *circuitBreaker) allow() error {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case breakerOpen:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			return errBreakerOpen
+		}
+		breaker.state = breakerHalfOpen
+		breaker.probeRunning = true
+		log.Printf("[circuitBreaker] %v: half-open, sending probe", breaker.name)
+		return nil
+	case breakerHalfOpen:
+		if breaker.probeRunning {
+			return errBreakerOpen
+		}
+		breaker.probeRunning = true
+		return nil
+	}
+
+	return nil
+}
+
+func (breaker *circuitBreaker) success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	if breaker.state != breakerClosed {
+		log.Printf("[circuitBreaker] %v: closed", breaker.name)
+	}
+
+	breaker.state = breakerClosed
+	breaker.consecutiveFailures = 0
+	breaker.probeRunning = false
+}
+
+func (breaker *circuitBreaker) failure(err error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.consecutiveFailures++
+	breaker.lastError = err.Error()
+
+	if breaker.state == breakerHalfOpen || breaker.consecutiveFailures >= breaker.threshold {
+		if breaker.state != breakerOpen {
+			log.Printf("[circuitBreaker] %v: open after %v failures: %v", breaker.name, breaker.consecutiveFailures, err)
+		}
+		breaker.state = breakerOpen
+		breaker.openedAt = time.Now()
+		breaker.probeRunning = false
+	}
+}
+
+func (breaker *circuitBreaker) status() breakerStatus {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	status := breakerStatus{
+		Name:                breaker.name,
+		State:               breaker.state,
+		ConsecutiveFailures: breaker.consecutiveFailures,
+		LastError:           breaker.lastError,
+	}
+
+	if breaker.state != breakerClosed {
+		openedAt := breaker.openedAt
+		retryAt := openedAt.Add(breaker.cooldown)
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+	}
+
+	return status
+}
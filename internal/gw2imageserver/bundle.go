@@ -0,0 +1,386 @@
+package gw2imageserver
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	bundleManifestName = "manifest.json"
+	bundleBlobPrefix   = "blobs/"
+	bundleVersion      = 1
+
+	// bundleMaxBlobSize guards imports against absurd tar headers
+	bundleMaxBlobSize = 256 << 20
+)
+
+// BundleFilter restricts which cache entries are exported. Zero values don't
+// filter; with an ID range set, files whose ID isn't a number are skipped.
+type BundleFilter struct {
+	MinID     uint64
+	MaxID     uint64
+	FileTypes []string
+}
+
+// A bundle is a tar stream of manifest.json followed by one blobs/<sha256>
+// per distinct content.
+type bundleManifest struct {
+	Version int           `json:"version"`
+	Created time.Time     `json:"created"`
+	Entries []bundleEntry `json:"entries"`
+}
+
+type bundleEntry struct {
+	File         string    `json:"file"`
+	FileType     string    `json:"fileType"`
+	LastModified time.Time `json:"lastModified"`
+	SHA256       string    `json:"sha256"`
+	Size         int       `json:"size"`
+
+	ETag             string `json:"etag,omitempty"`
+	UpstreamModified string `json:"upstreamModified,omitempty"`
+
+	derivation
+}
+
+type bundleImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Missing  int `json:"missing"`
+	Corrupt  int `json:"corrupt"`
+}
+
+func (filter BundleFilter) matches(fileID string, fileType string) bool {
+	if len(filter.FileTypes) > 0 {
+		found := false
+		for _, allowed := range filter.FileTypes {
+			found = found || allowed == fileType
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if filter.MinID == 0 && filter.MaxID == 0 {
+		return true
+	}
+
+	id, err := strconv.ParseUint(fileID, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return id >= filter.MinID && (filter.MaxID == 0 || id <= filter.MaxID)
+}
+
+// exportBundle only reads from the backend and holds no locks between
+// entries, so it can run while serving. Entries changed in the meantime are
+// left out.
+func (app *app) exportBundle(writer io.Writer, filter BundleFilter) (int, error) {
+	lister, ok := app.storage.(storageLister)
+	if !ok {
+		return 0, errNoListing
+	}
+
+	entries, err := lister.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := bundleManifest{
+		Version: bundleVersion,
+		Created: time.Now().UTC(),
+	}
+	byHash := map[string][]bundleEntry{}
+	var hashes []string
+
+	for _, entry := range entries {
+		if !filter.matches(entry.file, entry.fileType) {
+			continue
+		}
+
+		metadata, err := app.storage.getMetadata(entry.file, entry.fileType)
+		if err != nil {
+			return 0, err
+		} else if metadata == nil || metadata.hash == "" {
+			continue
+		}
+
+		exported := bundleEntry{
+			File:         metadata.file,
+			FileType:     metadata.fileType,
+			LastModified: metadata.lastModified.UTC(),
+			SHA256:       metadata.hash,
+			Size:         metadata.size,
+
+			ETag:             metadata.etag,
+			UpstreamModified: metadata.upstreamModified,
+
+			derivation: metadata.derivation,
+		}
+
+		manifest.Entries = append(manifest.Entries, exported)
+		if _, ok := byHash[exported.SHA256]; !ok {
+			hashes = append(hashes, exported.SHA256)
+		}
+		byHash[exported.SHA256] = append(byHash[exported.SHA256], exported)
+	}
+
+	// raw files go first, importing one drops variants of a different raw file
+	sort.SliceStable(hashes, func(i, j int) bool {
+		return byHash[hashes[i]][0].FileType == "uncompressed" && byHash[hashes[j]][0].FileType != "uncompressed"
+	})
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	tarWriter := tar.NewWriter(writer)
+
+	if err := writeTarFile(tarWriter, bundleManifestName, manifestData, manifest.Created); err != nil {
+		return 0, err
+	}
+
+	for _, hash := range hashes {
+		content := app.readBundleBlob(byHash[hash])
+		if content == nil {
+			log.Printf("[exportBundle] content of %v changed or vanished, leaving it out", hash)
+			continue
+		}
+
+		if err := writeTarFile(tarWriter, bundleBlobPrefix+hash, content, byHash[hash][0].LastModified); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("[exportBundle] exported %v entries with %v blobs", len(manifest.Entries), len(hashes))
+
+	return len(manifest.Entries), nil
+}
+
+// readBundleBlob returns the content shared by entries, from whichever entry
+// still has it.
+func (app *app) readBundleBlob(entries []bundleEntry) []byte {
+	for _, entry := range entries {
+		stored, err := app.storage.get(entry.File, entry.FileType)
+		if err != nil {
+			log.Printf("[exportBundle] couldn't read %v %v: %v", entry.File, entry.FileType, err)
+			continue
+		}
+
+		if stored != nil && contentHash(stored.content) == entry.SHA256 {
+			return stored.content
+		}
+	}
+
+	return nil
+}
+
+func writeTarFile(writer *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(content)
+
+	return err
+}
+
+// importBundle merges a bundle into the cache. Entries that are already
+// cached with the same or a newer lastModified are kept.
+func (app *app) importBundle(reader io.Reader) (*bundleImportResult, error) {
+	tarReader := tar.NewReader(reader)
+
+	header, err := tarReader.Next()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read bundle: %v", err)
+	} else if header.Name != bundleManifestName {
+		return nil, fmt.Errorf("bundle has to start with %v, not %v", bundleManifestName, header.Name)
+	}
+
+	manifest := bundleManifest{}
+	if err := json.NewDecoder(tarReader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", bundleManifestName, err)
+	} else if manifest.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %v", manifest.Version)
+	}
+
+	byHash := map[string][]bundleEntry{}
+	for _, entry := range manifest.Entries {
+		byHash[entry.SHA256] = append(byHash[entry.SHA256], entry)
+	}
+
+	result := bundleImportResult{}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &result, fmt.Errorf("couldn't read bundle: %v", err)
+		}
+
+		hash := strings.TrimPrefix(header.Name, bundleBlobPrefix)
+		entries, ok := byHash[hash]
+		if !strings.HasPrefix(header.Name, bundleBlobPrefix) || !ok {
+			log.Printf("[importBundle] ignoring %v", header.Name)
+			continue
+		}
+		delete(byHash, hash)
+
+		if header.Size > bundleMaxBlobSize {
+			return &result, fmt.Errorf("blob %v is too big: %v bytes", hash, header.Size)
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return &result, fmt.Errorf("couldn't read bundle: %v", err)
+		}
+
+		if contentHash(content) != hash {
+			log.Printf("[importBundle] blob %v is corrupt", hash)
+			result.Corrupt += len(entries)
+			continue
+		}
+
+		for _, entry := range entries {
+			imported, err := app.importBundleEntry(entry, content)
+			if err != nil {
+				return &result, err
+			}
+
+			if imported {
+				result.Imported++
+			} else {
+				result.Skipped++
+			}
+		}
+	}
+
+	for _, entries := range byHash {
+		result.Missing += len(entries)
+	}
+
+	log.Printf("[importBundle] %+v", result)
+
+	return &result, nil
+}
+
+func (app *app) importBundleEntry(entry bundleEntry, content []byte) (bool, error) {
+	existing, err := app.getFileMetadataFromCache(entry.File, entry.FileType)
+	if err != nil {
+		return false, err
+	}
+
+	if existing != nil && !existing.lastModified.Before(entry.LastModified) {
+		return false, nil
+	}
+
+	imported := &file{
+		file:         entry.File,
+		fileType:     entry.FileType,
+		lastModified: entry.LastModified,
+		content:      content,
+
+		etag:             entry.ETag,
+		upstreamModified: entry.UpstreamModified,
+
+		derivation: entry.derivation,
+	}
+	if err := app.saveFileToCache(imported); err != nil {
+		return false, err
+	}
+
+	// the bundle's server fetched it then
+	app.recordRevision(imported, entry.LastModified)
+
+	return true, nil
+}
+
+// openCache sets up the cache without the HTTP server, for the CLI.
+func openCache(config Config) (*app, error) {
+	app, err := newApp(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := app.initDB(config.Cache.SQLite); err != nil {
+		app.closeArchive()
+		return nil, err
+	}
+	if err := app.initStorage(config.Cache); err != nil {
+		app.closeDB()
+		app.closeArchive()
+		return nil, err
+	}
+
+	return app, nil
+}
+
+// ExportBundle writes the cache entries matching filter to a bundle at path.
+func ExportBundle(config Config, path string, filter BundleFilter) error {
+	app, err := openCache(config)
+	if err != nil {
+		return err
+	}
+	defer app.closeDB()
+	defer app.closeArchive()
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.exportBundle(temp, filter); err != nil {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// ImportBundle merges the bundle at path into the cache.
+func ImportBundle(config Config, path string) error {
+	app, err := openCache(config)
+	if err != nil {
+		return err
+	}
+	defer app.closeDB()
+	defer app.closeArchive()
+
+	bundle, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = bundle.Close() }()
+
+	_, err = app.importBundle(bundle)
+
+	return err
+}
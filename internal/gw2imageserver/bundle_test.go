@@ -0,0 +1,95 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBundleFromS3(t *testing.T) {
+	fake := newFakeS3(t)
+
+	source := newTestApp(t, func(config *Config) {
+		config.Cache.Backend = storageBackendS3
+		config.Cache.S3 = fake.config
+	})
+	saveTestEntries(t, source)
+
+	bundle := bytes.Buffer{}
+	if exported, err := source.exportBundle(&bundle, BundleFilter{}); err != nil || exported != 4 {
+		t.Fatalf("exported %v entries: %v", exported, err)
+	}
+
+	target := newTestApp(t, nil)
+	result, err := target.importBundle(&bundle)
+	if err != nil {
+		t.Fatal(err)
+	} else if *result != (bundleImportResult{Imported: 4}) {
+		t.Fatalf("got %+v", result)
+	}
+
+	entries, _, err := target.queryEntries(entryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"1 png", "1 uncompressed", "10 jpg", "2 png"}) {
+		t.Fatalf("imported %v", names)
+	}
+}
+
+func TestImportedRawFilesDropOutdatedVariants(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC()
+	newer := testFile("1", "uncompressed", []byte("new raw"))
+	variant := testFile("1", "png", []byte("new png"))
+	variant.derivation.SourceSHA256 = newer.hash
+
+	source := newTestApp(t, nil)
+	for _, saved := range []*file{variant, newer} {
+		if err := source.saveFileToCache(saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle := bytes.Buffer{}
+	if _, err := source.exportBundle(&bundle, BundleFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	partial := bytes.Buffer{}
+	if _, err := source.exportBundle(&partial, BundleFilter{FileTypes: []string{"uncompressed"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		bundle  *bytes.Buffer
+		variant string
+	}{
+		"with variants":    {&bundle, "new png"},
+		"without variants": {&partial, ""},
+	} {
+		target := newTestApp(t, nil)
+		for _, saved := range []*file{testFile("1", "uncompressed", []byte("old raw")), testFile("1", "png", []byte("old png"))} {
+			saved.lastModified = old
+			if err := target.saveFileToCache(saved); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := target.importBundle(bytes.NewReader(test.bundle.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+
+		cached, err := target.getFileFromCache("1", "png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := ""
+		if cached != nil {
+			got = string(cached.content)
+		}
+		if got != test.variant {
+			t.Errorf("%v: got variant %q, want %q", name, got, test.variant)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type cachePolicy string
+
+const (
+	// cachePolicyCacheOnly never contacts a source, misses are 404s.
+	cachePolicyCacheOnly cachePolicy = "cache-only"
+	// cachePolicyCacheFirst serves from the cache and refreshes entries once
+	// they are older than their TTL.
+	cachePolicyCacheFirst cachePolicy = "cache-first"
+	// cachePolicyUpstreamFirst revalidates the raw file on every request and
+	// only falls back to the cache if upstream fails.
+	cachePolicyUpstreamFirst cachePolicy = "upstream-first"
+)
+
+type CacheConfig struct {
+	// Backend is "sqlite" to keep files in cache.db, "filesystem" to keep
+	// them below Directory or "s3" to share them between replicas in a bucket.
+	Backend   string
+	SQLite    SQLiteConfig
+	Directory string
+	S3        S3Config
+
+	// MemoryBytes is the budget of the in-memory LRU in front of the backend,
+	// 0 disables it.
+	MemoryBytes int
+
+	// MaxBytes caps the size of the backend, 0 means unlimited. Every
+	// EvictInterval accesses are recorded and, if needed, entries evicted by
+	// EvictPolicy, "lru" or "lfu". Revisions of raw files are kept on top of
+	// that.
+	MaxBytes      int64
+	EvictInterval time.Duration
+	EvictPolicy   string
+
+	// VerifyReads is the share of reads from the backend whose hash is
+	// checked, between 0 and 1. ScrubInterval is the pause between two runs of
+	// the scrubber over the whole cache, 0 disables it.
+	VerifyReads   float64
+	ScrubInterval time.Duration
+
+	// Policy is one of "cache-only", "cache-first" or "upstream-first",
+	// empty means "cache-first".
+	Policy string
+
+	// TTLs is how long entries of a file type are fresh, types without a TTL
+	// use DefaultTTL; 0 means forever. Up to MaxStale after that, entries are
+	// still served while they are refreshed in the background; later requests
+	// wait for the refresh.
+	TTLs       map[string]time.Duration
+	DefaultTTL time.Duration
+	MaxStale   time.Duration
+
+	// RefreshRetry is how long an entry whose refresh failed is served as
+	// fresh before the next attempt, 0 means a minute.
+	RefreshRetry time.Duration
+}
+
+type freshness int
+
+const (
+	freshnessFresh freshness = iota
+	freshnessStale
+	freshnessExpired
+)
+
+func (config CacheConfig) ttl(fileType string) time.Duration {
+	if ttl, ok := config.TTLs[fileType]; ok {
+		return ttl
+	}
+
+	return config.DefaultTTL
+}
+
+func parseCachePolicy(policy string) (cachePolicy, error) {
+	switch cachePolicy(policy) {
+	case "":
+		return cachePolicyCacheFirst, nil
+	case cachePolicyCacheOnly, cachePolicyCacheFirst, cachePolicyUpstreamFirst:
+		return cachePolicy(policy), nil
+	}
+
+	return "", fmt.Errorf("unknown cache policy: %v", policy)
+}
+
+func (app *app) freshness(file *file, policy cachePolicy) freshness {
+	switch policy {
+	case cachePolicyCacheOnly:
+		return freshnessFresh
+	case cachePolicyUpstreamFirst:
+		return freshnessExpired
+	}
+
+	ttl := app.cacheConfig.ttl(file.fileType)
+	if ttl <= 0 || app.backingOff(file.file, file.fileType) {
+		return freshnessFresh
+	}
+
+	age := time.Since(file.lastModified)
+	if age < ttl {
+		return freshnessFresh
+	} else if age < ttl+app.cacheConfig.MaxStale {
+		return freshnessStale
+	}
+
+	return freshnessExpired
+}
+
+// cacheControl tells clients the same TTLs the server uses. Entries served
+// because upstream failed must not be cached at all.
+func (app *app) cacheControl(file *file, failed bool) string {
+	if failed {
+		return "public, max-age=0"
+	}
+
+	ttl := app.cacheConfig.ttl(file.fileType)
+	if ttl <= 0 {
+		return "public, max-age=31536000, immutable"
+	}
+
+	remaining := ttl - time.Since(file.lastModified)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	if app.cacheConfig.MaxStale <= 0 {
+		return fmt.Sprintf("public, max-age=%d", int64(remaining.Seconds()))
+	}
+
+	return fmt.Sprintf("public, max-age=%d, stale-while-revalidate=%d", int64(remaining.Seconds()), int64(app.cacheConfig.MaxStale.Seconds()))
+}
+
+// refreshEntry revalidates the raw file behind an entry and reports whether
+// it changed. Unchanged derived entries are fresh again afterwards, changed
+// ones are gone and have to be rendered again.
+func (app *app) refreshEntry(fileID string, fileType string, prio priority) (bool, error) {
+	changed, err := app.revalidateRaw(fileID, prio)
+	if err != nil || changed || fileType == "uncompressed" {
+		return changed, err
+	}
+
+	return false, app.touchFileInCache(&file{
+		file:         fileID,
+		fileType:     fileType,
+		lastModified: time.Now().UTC(),
+	})
+}
+
+// refreshInBackground runs refreshEntry unless it's already running for the
+// entry, and renders changed entries again right away.
+func (app *app) refreshInBackground(fileID string, fileType string) {
+	select {
+	case <-app.done:
+		return
+	default:
+	}
+
+	key := coalesceKey(fileID, fileType)
+	if _, running := app.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+		defer app.refreshing.Delete(key)
+
+		changed, err := app.refreshEntry(fileID, fileType, priorityBackground)
+		if err != nil {
+			log.Printf("[refreshInBackground] %v %v: %v", fileID, fileType, err)
+			app.backOffRefresh(fileID, fileType)
+			return
+		}
+
+		if changed && fileType != "uncompressed" {
+			if _, err := app.noImageFileInCache(fileID, fileType, false, cachePolicyCacheFirst); err != nil {
+				log.Printf("[refreshInBackground] couldn't render %v %v: %v", fileID, fileType, err)
+			}
+		}
+	}()
+}
+
+// backOffRefresh keeps an entry whose refresh failed fresh for RefreshRetry,
+// so requests neither wait for nor start another doomed refresh meanwhile.
+func (app *app) backOffRefresh(fileID string, fileType string) {
+	retry := app.cacheConfig.RefreshRetry
+	if retry <= 0 {
+		retry = time.Minute
+	}
+
+	app.retryRefresh.Store(coalesceKey(fileID, fileType), time.Now().Add(retry))
+}
+
+// backingOff reports whether the last refresh of an entry failed less than
+// RefreshRetry ago.
+func (app *app) backingOff(fileID string, fileType string) bool {
+	key := coalesceKey(fileID, fileType)
+
+	retryAt, ok := app.retryRefresh.Load(key)
+	if !ok {
+		return false
+	} else if time.Now().Before(retryAt.(time.Time)) {
+		return true
+	}
+
+	app.retryRefresh.Delete(key)
+
+	return false
+}
@@ -0,0 +1,45 @@
+package gw2imageserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailedRefreshesBackOff(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	app := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+		config.Cache.DefaultTTL = time.Hour
+		config.Cache.MaxStale = time.Minute
+	})
+
+	lookupPNG(t, app, "1", cachePolicyCacheFirst)
+
+	// expire the variant and take upstream down
+	expired := time.Now().Add(-2 * time.Hour).UTC()
+	if err := app.touchFileInCache(&file{file: "1", fileType: "png", lastModified: expired}); err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close()
+
+	if _, failed := lookupPNG(t, app, "1", cachePolicyCacheFirst); !failed {
+		t.Fatal("serving after a failed refresh isn't reported as failed")
+	}
+
+	cached, err := app.getFileMetadataFromCache("1", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freshness := app.freshness(cached, cachePolicyCacheFirst); freshness != freshnessFresh {
+		t.Fatalf("got freshness %v after a failed refresh, want fresh", freshness)
+	}
+	if cached.lastModified.Unix() != expired.Unix() {
+		t.Fatalf("got lastModified %v after a failed refresh, want it unchanged", cached.lastModified)
+	}
+
+	if _, failed := lookupPNG(t, app, "1", cachePolicyCacheFirst); failed {
+		t.Fatal("the next request tried to refresh again")
+	}
+}
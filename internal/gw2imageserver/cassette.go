@@ -0,0 +1,154 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	cassetteModeRecord = "record"
+	cassetteModeReplay = "replay"
+)
+
+type CassetteConfig struct {
+	// Mode is "record" to store every upstream exchange, "replay" to answer
+	// from stored exchanges without touching the network, or empty.
+	Mode      string
+	Directory string
+}
+
+type cassette struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+type cassetteTransport struct {
+	config CassetteConfig
+	next   http.RoundTripper
+}
+
+func newCassetteTransport(config CassetteConfig, next http.RoundTripper) (http.RoundTripper, error) {
+	switch config.Mode {
+	case "":
+		return next, nil
+	case cassetteModeRecord:
+		if err := os.MkdirAll(config.Directory, 0755); err != nil {
+			return nil, err
+		}
+	case cassetteModeReplay:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode: %v", config.Mode)
+	}
+
+	log.Printf("[cassette] %v mode, directory=%v", config.Mode, config.Directory)
+
+	return &cassetteTransport{
+		config: config,
+		next:   next,
+	}, nil
+}
+
+// conditionalHeaders are part of a recording's key, so that the 304 of a
+// revalidation doesn't replace the 200 of the first fetch.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+func (transport *cassetteTransport) path(request *http.Request) string {
+	key := request.Method + " " + request.URL.String()
+	for _, name := range conditionalHeaders {
+		if value := request.Header.Get(name); value != "" {
+			key += "\n" + name + ": " + value
+		}
+	}
+
+	hash := sha256.Sum256([]byte(key))
+
+	return filepath.Join(transport.config.Directory, hex.EncodeToString(hash[:])+".json")
+}
+
+func (transport *cassetteTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if transport.config.Mode == cassetteModeReplay {
+		return transport.replay(request)
+	}
+
+	return transport.record(request)
+}
+
+func (transport *cassetteTransport) replay(request *http.Request) (*http.Response, error) {
+	data, err := ioutil.ReadFile(transport.path(request))
+	if os.IsNotExist(err) {
+		log.Printf("[cassette] no recording for %v %v", request.Method, request.URL)
+
+		return &http.Response{
+			Status:     http.StatusText(http.StatusNotFound),
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    request,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	recorded := cassette{}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("corrupt cassette for %v: %v", request.URL, err)
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(recorded.StatusCode),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       request,
+	}, nil
+}
+
+func (transport *cassetteTransport) record(request *http.Request) (*http.Response, error) {
+	response, err := transport.next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	data, err := json.MarshalIndent(cassette{
+		Method:     request.Method,
+		URL:        request.URL.String(),
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       body,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(transport.path(request), data); err != nil {
+		log.Printf("[cassette] couldn't record %v: %v", request.URL, err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,84 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+type coalescedCall struct {
+	wg sync.WaitGroup
+
+	file *file
+	err  error
+
+	waiters int
+}
+
+type coalescer struct {
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		calls: map[string]*coalescedCall{},
+	}
+}
+
+func coalesceKey(fileID string, fileType string) string {
+	return fileID + "\x00" + fileType
+}
+
+// do runs fn once per (fileID, fileType) at a time; concurrent callers with the
+// same key wait for the running call and share its result.
+func (c *coalescer) do(fileID string, fileType string, fn func() (*file, error)) (*file, error) {
+	key := coalesceKey(fileID, fileType)
+
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mutex.Unlock()
+
+		log.Printf("[coalescer] waiting for running call: file=%v type=%v", fileID, fileType)
+		call.wg.Wait()
+
+		return call.file, call.err
+	}
+
+	call := &coalescedCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		waiters := call.waiters
+		c.mutex.Unlock()
+
+		call.wg.Done()
+
+		if waiters > 0 {
+			log.Printf("[coalescer] shared result with %v waiters: file=%v type=%v", waiters, fileID, fileType)
+		}
+	}()
+
+	call.file, call.err = call.run(fn)
+
+	return call.file, call.err
+}
+
+// run turns a panic of fn, e.g. in a decoder fed broken data, into an error
+// for the caller and all waiters.
+func (call *coalescedCall) run(fn func() (*file, error)) (file *file, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("[coalescer] panic: %v\n%s", recovered, debug.Stack())
+			file, err = nil, fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	return fn()
+}
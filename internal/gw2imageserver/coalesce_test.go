@@ -0,0 +1,77 @@
+package gw2imageserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesResult(t *testing.T) {
+	c := newCoalescer()
+	release := make(chan struct{})
+	calls := 0
+
+	results := make(chan *file, 2)
+	wait := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			file, _ := c.do("1", "png", func() (*file, error) {
+				calls++
+				<-release
+				return &file{file: "1"}, nil
+			})
+			results <- file
+		}()
+	}
+
+	// let the second caller find the running call
+	for {
+		c.mutex.Lock()
+		call := c.calls[coalesceKey("1", "png")]
+		waiting := call != nil && call.waiters == 1
+		c.mutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wait.Wait()
+
+	if calls != 1 {
+		t.Fatalf("fn ran %v times, want 1", calls)
+	}
+	if first, second := <-results, <-results; first != second || first == nil {
+		t.Fatalf("results differ: %v %v", first, second)
+	}
+}
+
+func TestCoalescerRecoversPanics(t *testing.T) {
+	c := newCoalescer()
+
+	_, err := c.do("1", "png", func() (*file, error) {
+		panic("broken texture")
+	})
+	if err == nil {
+		t.Fatal("want an error for a panicking call")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.do("1", "png", func() (*file, error) {
+			return &file{}, nil
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("later call failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("later call blocked after a panic")
+	}
+}
@@ -2,77 +2,232 @@ package gw2imageserver
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func (app *app) initDB() error {
-	db, err := sql.Open("sqlite3", "./cache.db")
+func (app *app) initDB(config SQLiteConfig) error {
+	db, err := openSQLite(config)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS 
-			raw
-		(
-			file TEXT NOT NULL,
-			lastModified TEXT,
-			fileType TEXT,
-			content BLOB,
+	app.db = db
 
-			CONSTRAINT file_fileType UNIQUE (file, filetype)
-		)
-	`)
+	return nil
+}
 
-	if err != nil {
-		return err
-	}
+// sqliteStorage keeps the metadata of files in the raw table and their
+// content in the blob table, keyed by hash, so identical content is only
+// stored once.
+type sqliteStorage struct {
+	db *sqliteDB
 
-	_, err = db.Exec(`
-		CREATE INDEX IF NOT EXISTS 
-			raw_file_fileType
-		ON 
-			raw
-		(
-			file,
-			fileType
-		)
-	`)
+	// on the readers
+	selectFile      *sql.Stmt
+	selectMetadata  *sql.Stmt
+	selectEntries   *sql.Stmt
+	selectRevisions *sql.Stmt
+	selectRevision  *sql.Stmt
+
+	// on the writer
+	selectHash          *sql.Stmt
+	selectDerivedHashes *sql.Stmt
+	insertBlob          *sql.Stmt
+	insertRaw           *sql.Stmt
+	updateLastModified  *sql.Stmt
+	updateAccess        *sql.Stmt
+	deleteRaw           *sql.Stmt
+	deleteDerivedRaw    *sql.Stmt
+	deleteUnusedBlob    *sql.Stmt
+	updateRevision      *sql.Stmt
+	insertRevision      *sql.Stmt
+}
+
+const sqliteSelectFile = `
+	SELECT 
+		raw.file, 
+		raw.lastModified, 
+		raw.fileType,
+		%v,
+		raw.size,
+		raw.sha256,
+		raw.etag,
+		raw.upstreamModified,
+		raw.sourceSha256,
+		raw.decoderVersion,
+		raw.encodeOptions,
+		raw.width,
+		raw.height
+	FROM 
+		raw 
+	LEFT JOIN
+		blob ON blob.sha256 = raw.sha256
+	WHERE 
+		raw.file = ? AND raw.fileType = ?`
+
+func newSQLiteStorage(db *sqliteDB) (*sqliteStorage, error) {
+	storage := sqliteStorage{
+		db: db,
+	}
 
+	err := db.prepareAll(db.reader,
+		sqlStatement{&storage.selectFile, fmt.Sprintf(sqliteSelectFile, "blob.content")},
+		sqlStatement{&storage.selectMetadata, fmt.Sprintf(sqliteSelectFile, "NULL")},
+		sqlStatement{&storage.selectEntries, `
+			SELECT
+				file,
+				fileType,
+				size,
+				IFNULL(lastAccess, 0),
+				hits
+			FROM
+				raw`},
+		sqlStatement{&storage.selectRevisions, `
+			SELECT
+				revision,
+				sha256,
+				size,
+				firstSeen,
+				lastSeen
+			FROM
+				revision
+			WHERE
+				file = ?
+			ORDER BY
+				revision`},
+		sqlStatement{&storage.selectRevision, `
+			SELECT
+				revision.sha256,
+				revision.size,
+				revision.lastSeen,
+				blob.content
+			FROM
+				revision
+			JOIN
+				blob ON blob.sha256 = revision.sha256
+			WHERE
+				revision.file = ? AND revision.revision = ?`},
+	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	app.db = db
+	err = db.prepareAll(db.writer,
+		sqlStatement{&storage.selectHash, `SELECT sha256 FROM raw WHERE file = ? AND fileType = ?`},
+		sqlStatement{&storage.selectDerivedHashes, `SELECT sha256 FROM raw WHERE file = ? AND fileType != 'uncompressed'`},
+		sqlStatement{&storage.insertBlob, `
+			INSERT INTO
+				blob
+					(
+						sha256, content
+					)
+			VALUES
+					(?, ?)
+			ON CONFLICT (sha256) DO UPDATE SET
+				content = excluded.content
+			WHERE
+				content != excluded.content`},
+		sqlStatement{&storage.insertRaw, `
+			INSERT OR REPLACE INTO
+				raw
+					(
+						file, lastModified, fileType, sha256, size, etag, upstreamModified, lastAccess,
+						sourceSha256, decoderVersion, encodeOptions, width, height
+					)
+			VALUES
+					(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`},
+		sqlStatement{&storage.updateLastModified, `
+			UPDATE
+				raw
+			SET
+				lastModified = ?
+			WHERE
+				file = ? AND fileType = ?`},
+		sqlStatement{&storage.updateAccess, `
+			UPDATE
+				raw
+			SET
+				lastAccess = MAX(IFNULL(lastAccess, 0), ?),
+				hits = hits + ?
+			WHERE
+				file = ? AND fileType = ?`},
+		sqlStatement{&storage.deleteRaw, `
+			DELETE FROM
+				raw
+			WHERE
+				file = ? AND fileType = ?`},
+		sqlStatement{&storage.deleteDerivedRaw, `
+			DELETE FROM
+				raw
+			WHERE
+				file = ? AND fileType != 'uncompressed'`},
+		sqlStatement{&storage.deleteUnusedBlob, `
+			DELETE FROM
+				blob
+			WHERE
+				sha256 = ?
+				AND NOT EXISTS (SELECT 1 FROM raw WHERE sha256 = ?)
+				AND NOT EXISTS (SELECT 1 FROM revision WHERE sha256 = ?)`},
+		sqlStatement{&storage.updateRevision, `
+			UPDATE
+				revision
+			SET
+				firstSeen = MIN(firstSeen, ?),
+				lastSeen = MAX(lastSeen, ?)
+			WHERE
+				file = ? AND sha256 = ?`},
+		sqlStatement{&storage.insertRevision, `
+			INSERT INTO
+				revision
+					(
+						file, revision, sha256, size, firstSeen, lastSeen
+					)
+			SELECT
+				?, IFNULL(MAX(revision), 0) + 1, ?, ?, ?, ?
+			FROM
+				revision
+			WHERE
+				file = ?`},
+	)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return &storage, nil
 }
 
-func (app *app) getFileFromCache(fileToLookup string, fileTypeToLookup string) (*file, error) {
-	log.Printf("[getFileFromCache] fileToLookup=%v type=%v", fileToLookup, fileTypeToLookup)
+func (storage *sqliteStorage) get(fileToLookup string, fileTypeToLookup string) (*file, error) {
+	return scanFile(storage.selectFile.QueryRow(fileToLookup, fileTypeToLookup))
+}
 
-	row := app.db.QueryRow(`
-	SELECT 
-		file, 
-		lastModified, 
-		fileType,
-		content 
-	FROM 
-		raw 
-	WHERE 
-		file = ? AND fileType = ?`, fileToLookup, fileTypeToLookup)
+func (storage *sqliteStorage) getMetadata(fileToLookup string, fileTypeToLookup string) (*file, error) {
+	return scanFile(storage.selectMetadata.QueryRow(fileToLookup, fileTypeToLookup))
+}
 
+func scanFile(row *sql.Row) (*file, error) {
 	file := file{}
-	var lastModified string
+	var lastModified int64
+	var etag, upstreamModified, sourceHash, options sql.NullString
+	var version, width, height sql.NullInt64
 
 	err := row.Scan(
 		&file.file,
 		&lastModified,
 		&file.fileType,
 		&file.content,
+		&file.size,
+		&file.hash,
+		&etag,
+		&upstreamModified,
+		&sourceHash,
+		&version,
+		&options,
+		&width,
+		&height,
 	)
 
 	if err != nil && err != sql.ErrNoRows {
@@ -82,34 +237,379 @@ func (app *app) getFileFromCache(fileToLookup string, fileTypeToLookup string) (
 		return nil, nil
 	}
 
-	file.lastModified, err = time.Parse(time.RFC1123Z, lastModified)
+	file.lastModified = time.Unix(lastModified, 0).UTC()
+	file.etag = etag.String
+	file.upstreamModified = upstreamModified.String
+	file.derivation = derivation{
+		SourceSHA256:   sourceHash.String,
+		DecoderVersion: int(version.Int64),
+		EncodeOptions:  options.String,
+		Width:          int(width.Int64),
+		Height:         int(height.Int64),
+	}
+
+	return &file, nil
+}
+
+// raw files store NULL instead of an empty derivation
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func nullInt(value int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(value), Valid: value != 0}
+}
+
+func selectHashes(statement *sql.Stmt, args ...interface{}) ([]string, error) {
+	rows, err := statement.Query(args...)
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = rows.Close() }()
 
-	return &file, nil
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// releaseBlobs drops blobs nothing refers to anymore.
+func (storage *sqliteStorage) releaseBlobs(tx *sql.Tx, hashes []string) error {
+	for _, hash := range hashes {
+		if _, err := tx.Stmt(storage.deleteUnusedBlob).Exec(hash, hash, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *sqliteStorage) save(file *file) error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		previous, err := selectHashes(tx.Stmt(storage.selectHash), file.file, file.fileType)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Stmt(storage.insertBlob).Exec(file.hash, file.content); err != nil {
+			return err
+		}
+
+		_, err = tx.Stmt(storage.insertRaw).Exec(
+			file.file, file.lastModified.Unix(), file.fileType, file.hash, len(file.content),
+			file.etag, file.upstreamModified, time.Now().Unix(),
+			nullString(file.derivation.SourceSHA256), nullInt(file.derivation.DecoderVersion),
+			nullString(file.derivation.EncodeOptions), nullInt(file.derivation.Width), nullInt(file.derivation.Height),
+		)
+		if err != nil {
+			return err
+		}
+
+		return storage.releaseBlobs(tx, previous)
+	})
+}
+
+func (storage *sqliteStorage) touch(file *file) error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(storage.updateLastModified).Exec(file.lastModified.Unix(), file.file, file.fileType)
+		return err
+	})
+}
+
+func (storage *sqliteStorage) deleteDerived(fileToDelete string) error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		released, err := selectHashes(tx.Stmt(storage.selectDerivedHashes), fileToDelete)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Stmt(storage.deleteDerivedRaw).Exec(fileToDelete); err != nil {
+			return err
+		}
+
+		return storage.releaseBlobs(tx, released)
+	})
+}
+
+func (storage *sqliteStorage) delete(fileToDelete string, fileTypeToDelete string) error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		released, err := selectHashes(tx.Stmt(storage.selectHash), fileToDelete, fileTypeToDelete)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Stmt(storage.deleteRaw).Exec(fileToDelete, fileTypeToDelete); err != nil {
+			return err
+		}
+
+		return storage.releaseBlobs(tx, released)
+	})
+}
+
+func (storage *sqliteStorage) recordAccesses(accesses []storageAccess) error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		updateAccess := tx.Stmt(storage.updateAccess)
+
+		for _, access := range accesses {
+			if _, err := updateAccess.Exec(access.lastAccess.Unix(), access.hits, access.file, access.fileType); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// compact runs an incremental vacuum, which truncates the pages deleted
+// entries left behind.
+func (storage *sqliteStorage) compact() error {
+	return storage.db.write(func(tx *sql.Tx) error {
+		// every step of the pragma frees one page
+		rows, err := tx.Query("PRAGMA incremental_vacuum")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rows.Close() }()
+
+		for rows.Next() {
+		}
+
+		return rows.Err()
+	})
+}
+
+func (storage *sqliteStorage) entries() ([]storageEntry, error) {
+	rows, err := storage.selectEntries.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanEntries(rows)
+}
+
+func scanEntries(rows *sql.Rows) ([]storageEntry, error) {
+	defer func() { _ = rows.Close() }()
+
+	var entries []storageEntry
+	for rows.Next() {
+		entry := storageEntry{}
+		var lastAccess int64
+
+		if err := rows.Scan(&entry.file, &entry.fileType, &entry.size, &lastAccess, &entry.hits); err != nil {
+			return nil, err
+		}
+		entry.lastAccess = time.Unix(lastAccess, 0)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+var sqliteEntryOrder = map[string]string{
+	"":           "file, fileType",
+	"file":       "file, fileType",
+	"size":       "size DESC, file, fileType",
+	"hits":       "hits DESC, file, fileType",
+	"lastAccess": "IFNULL(lastAccess, 0) DESC, file, fileType",
 }
 
-func (app *app) saveFileToCache(file *file) error {
-	log.Printf("[saveFileToCache] file=%v type=%v size=%v time=%v", file.file, file.fileType, len(file.content), file.lastModified)
+// queryEntries filters, sorts and pages in SQL, so listing a page doesn't
+// read the whole table.
+func (storage *sqliteStorage) queryEntries(query entryQuery) ([]storageEntry, int, error) {
+	order, ok := sqliteEntryOrder[query.sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid sort: %v", query.sort)
+	}
+
+	where := `substr(file, 1, length(?)) = ?`
+	args := []interface{}{query.filePrefix, query.filePrefix}
+	if query.file != "" {
+		where += ` AND file = ?`
+		args = append(args, query.file)
+	}
+	if query.fileType != "" {
+		where += ` AND fileType = ?`
+		args = append(args, query.fileType)
+	}
 
-	lastModified := file.lastModified.Format(time.RFC1123Z)
+	total := 0
+	if err := storage.db.reader.QueryRow(`SELECT COUNT(*) FROM raw WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	limit := query.limit
+	if limit < 1 {
+		limit = -1
+	}
 
-	_, err := app.db.Exec(`
-		INSERT OR REPLACE INTO
+	rows, err := storage.db.reader.Query(`
+		SELECT
+			file,
+			fileType,
+			size,
+			IFNULL(lastAccess, 0),
+			hits
+		FROM
 			raw
-				(
-					file, lastModified, fileType, content
-				)
-		VALUES
-				(?, ?, ?, ?)
-	`, file.file, lastModified, file.fileType, file.content)
+		WHERE
+			`+where+`
+		ORDER BY
+			`+order+`
+		LIMIT ? OFFSET ?`, append(args, limit, query.offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries, err := scanEntries(rows)
+
+	return entries, total, err
+}
+
+func (storage *sqliteStorage) typeStats() (map[string]cacheTypeStats, error) {
+	rows, err := storage.db.reader.Query(`SELECT fileType, COUNT(*), IFNULL(SUM(size), 0) FROM raw GROUP BY fileType`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	stats := map[string]cacheTypeStats{}
+	for rows.Next() {
+		var fileType string
+		typeStats := cacheTypeStats{}
+
+		if err := rows.Scan(&fileType, &typeStats.Entries, &typeStats.Bytes); err != nil {
+			return nil, err
+		}
+		stats[fileType] = typeStats
+	}
+
+	return stats, rows.Err()
+}
+
+func (storage *sqliteStorage) recordRevision(file *file, seen time.Time) error {
+	size := file.size
+	if file.content != nil {
+		size = len(file.content)
+	}
+
+	return storage.db.write(func(tx *sql.Tx) error {
+		result, err := tx.Stmt(storage.updateRevision).Exec(seen.Unix(), seen.Unix(), file.file, file.hash)
+		if err != nil {
+			return err
+		}
+
+		if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+			return err
+		}
+
+		_, err = tx.Stmt(storage.insertRevision).Exec(file.file, file.hash, size, seen.Unix(), seen.Unix(), file.file)
+
+		return err
+	})
+}
+
+func (storage *sqliteStorage) revisions(fileID string) ([]revision, error) {
+	rows, err := storage.selectRevisions.Query(fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var revisions []revision
+	for rows.Next() {
+		entry := revision{}
+		var firstSeen, lastSeen int64
+
+		if err := rows.Scan(&entry.number, &entry.hash, &entry.size, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		entry.firstSeen = time.Unix(firstSeen, 0)
+		entry.lastSeen = time.Unix(lastSeen, 0)
+
+		revisions = append(revisions, entry)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (storage *sqliteStorage) getRevision(fileID string, number int) (*file, error) {
+	file := file{
+		file:     fileID,
+		fileType: "uncompressed",
+	}
+	var lastSeen int64
+
+	err := storage.selectRevision.QueryRow(fileID, number).Scan(&file.hash, &file.size, &lastSeen, &file.content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	file.lastModified = time.Unix(lastSeen, 0).UTC()
+
+	return &file, nil
+}
+
+func (app *app) getFileBySignature(signature string) (string, error) {
+	row := app.db.reader.QueryRow(`
+	SELECT 
+		file 
+	FROM 
+		signature 
+	WHERE 
+		signature = ?`, signature)
+
+	var fileID string
+
+	err := row.Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return fileID, err
+}
+
+// saveSignature remembers the first file a signature was imported with and
+// reports whether it was new. Later imports can't move it to another file.
+func (app *app) saveSignature(signature string, fileID string) (bool, error) {
+	knownFileID, err := app.getFileBySignature(signature)
+	if err != nil {
+		return false, err
+	}
+	if knownFileID == fileID {
+		return false, nil
+	} else if knownFileID != "" {
+		log.Printf("[saveSignature] signature %v belongs to file %v, ignoring %v", signature, knownFileID, fileID)
+		return false, nil
+	}
+
+	err = app.db.write(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO
+				signature
+					(
+						signature, file, firstSeen
+					)
+			VALUES
+					(?, ?, ?)
+		`, signature, fileID, time.Now().Unix())
+
+		return err
+	})
 
-	return err
+	return err == nil, err
 }
 
 func (app *app) closeDB() {
-	if err := app.db.Close(); err != nil {
+	if err := app.db.close(); err != nil {
 		log.Printf("[closeDB] %v", err)
 	}
 }
@@ -0,0 +1,152 @@
+package gw2imageserver
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSignatureKeepsFirstFile(t *testing.T) {
+	app := newTestApp(t, nil)
+	signature := "0123456789ABCDEF0123456789ABCDEF01234567"
+
+	if saved, err := app.saveSignature(signature, "1"); err != nil || !saved {
+		t.Fatalf("got %v, %v for a new signature", saved, err)
+	}
+	if saved, err := app.saveSignature(signature, "2"); err != nil || saved {
+		t.Fatalf("got %v, %v for a known signature", saved, err)
+	}
+
+	fileID, err := app.getFileBySignature(signature)
+	if err != nil || fileID != "1" {
+		t.Fatalf("got %q, %v, want file 1", fileID, err)
+	}
+
+	var firstSeen int64
+	if err := app.db.reader.QueryRow(`SELECT firstSeen FROM signature`).Scan(&firstSeen); err != nil || firstSeen == 0 {
+		t.Fatalf("got firstSeen %v, %v", firstSeen, err)
+	}
+}
+
+func TestSignaturesAreOnlyImported(t *testing.T) {
+	app := newTestApp(t, nil)
+	signature := "0123456789ABCDEF0123456789ABCDEF01234567"
+
+	if fileID, err := app.signedFileID(signature, "1"); err != nil || fileID != "1" {
+		t.Fatalf("got %q, %v for an ID", fileID, err)
+	}
+	if fileID, err := app.signedFileID(signature, "icon"); err != nil || fileID != "" {
+		t.Fatalf("a request taught the signature file %q, %v", fileID, err)
+	}
+
+	invalid := []signatureView{{Signature: signature, File: "2"}, {Signature: "nope", File: "3"}}
+	if _, err := app.saveSignatures(invalid); err == nil {
+		t.Fatal("imported an invalid signature")
+	}
+	if fileID, err := app.getFileBySignature(signature); err != nil || fileID != "" {
+		t.Fatalf("a failed import saved file %q, %v", fileID, err)
+	}
+
+	imported := []signatureView{{Signature: strings.ToLower(signature), File: "2"}, {Signature: signature, File: "3"}}
+	if result, err := app.saveSignatures(imported); err != nil || result != (signatureImport{Imported: 1, Skipped: 1}) {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+	if fileID, err := app.signedFileID(signature, "icon"); err != nil || fileID != "2" {
+		t.Fatalf("got %q, %v, want the imported file", fileID, err)
+	}
+}
+
+func pragma(t *testing.T, app *app, name string) int {
+	t.Helper()
+
+	value := 0
+	if err := app.db.reader.QueryRow("PRAGMA " + name).Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestCompactShrinksDatabase(t *testing.T) {
+	app := newTestApp(t, nil)
+
+	if mode := pragma(t, app, "auto_vacuum"); mode != 2 {
+		t.Fatalf("got auto_vacuum %v, want incremental", mode)
+	}
+
+	if err := app.saveFileToCache(testFile("1", "png", make([]byte, 1<<20))); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.deleteFileFromCache("1", "png"); err != nil {
+		t.Fatal(err)
+	}
+	if pragma(t, app, "freelist_count") == 0 {
+		t.Fatal("deleting left no free pages")
+	}
+
+	app.compact()
+
+	if free := pragma(t, app, "freelist_count"); free != 0 {
+		t.Fatalf("got %v free pages after compacting", free)
+	}
+}
+
+func TestFailedWriteKeepsTheRestOfItsBatch(t *testing.T) {
+	app := newTestApp(t, nil)
+
+	if _, err := app.db.writer.Exec("CREATE TABLE batch_test (value INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(value int) *sqliteWrite {
+		return &sqliteWrite{
+			fn: func(tx *sql.Tx) error {
+				_, err := tx.Exec("INSERT INTO batch_test (value) VALUES (?)", value)
+				return err
+			},
+			done: make(chan error, 1),
+		}
+	}
+	failing := &sqliteWrite{
+		fn:   func(tx *sql.Tx) error { return errors.New("failing write") },
+		done: make(chan error, 1),
+	}
+
+	batch := []*sqliteWrite{insert(1), failing, insert(2)}
+	app.db.commit(batch)
+
+	for i, write := range batch {
+		if err := <-write.done; (err != nil) != (write == failing) {
+			t.Fatalf("write %v: got %v", i, err)
+		}
+	}
+
+	count := 0
+	if err := app.db.reader.QueryRow("SELECT COUNT(*) FROM batch_test").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("got %v rows, want the 2 good writes", count)
+	}
+}
+
+func BenchmarkSQLiteConcurrentSave(b *testing.B) {
+	app := newTestApp(b, nil)
+	content := make([]byte, 4<<10)
+
+	var next int64
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			fileID := strconv.FormatInt(atomic.AddInt64(&next, 1), 10)
+			if err := app.saveFileToCache(testFile(fileID, "png", content)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"log"
+)
+
+// decoderVersion identifies the output of decodeTexture and the encoders.
+// Bump it whenever that output changes, so cached variants get rebuilt.
+const decoderVersion = 1
+
+const (
+	pngEncodeOptions = "compression=best"
+
+	jpegQuality = 90
+)
+
+// derivation records what a variant was generated from. Raw files don't
+// have one.
+type derivation struct {
+	SourceSHA256   string `json:"sourceSha256,omitempty"`
+	DecoderVersion int    `json:"decoderVersion,omitempty"`
+	EncodeOptions  string `json:"encodeOptions,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+}
+
+func encodeOptions(fileType string) string {
+	switch fileType {
+	case "png":
+		return pngEncodeOptions
+	case "jpg":
+		return fmt.Sprintf("quality=%v", jpegQuality)
+	}
+
+	return ""
+}
+
+// isOutdated reports whether a variant has to be built again because it
+// was built by another decoder or with other options. Variants from before
+// derivations were recorded are outdated as well. Saving a changed raw file
+// drops its variants, so serving doesn't have to look the raw file up.
+func (app *app) isOutdated(variant *file) bool {
+	if variant.fileType == "uncompressed" {
+		return false
+	}
+
+	if variant.derivation.DecoderVersion != decoderVersion || variant.derivation.EncodeOptions != encodeOptions(variant.fileType) {
+		log.Printf("[isOutdated] %v %v was built by decoder %v with %q", variant.file, variant.fileType, variant.derivation.DecoderVersion, variant.derivation.EncodeOptions)
+		return true
+	}
+
+	return false
+}
+
+// hasOtherSource reports whether a variant was built from another revision
+// of the raw file than the cached one, which the scrubber checks in case
+// dropping it failed.
+func (app *app) hasOtherSource(variant *file) bool {
+	if variant.fileType == "uncompressed" {
+		return false
+	}
+
+	raw, err := app.getFileMetadataFromCache(variant.file, "uncompressed")
+	if err != nil {
+		log.Printf("[hasOtherSource] couldn't look up the raw file of %v: %v", variant.file, err)
+		return false
+	} else if raw == nil || raw.hash == "" {
+		// nothing to compare with, the variant is all we have
+		return false
+	}
+
+	if raw.hash != variant.derivation.SourceSHA256 {
+		log.Printf("[hasOtherSource] %v %v was built from %v, the raw file is %v", variant.file, variant.fileType, variant.derivation.SourceSHA256, raw.hash)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,256 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	evictPolicyLRU = "lru"
+	evictPolicyLFU = "lfu"
+)
+
+type storageAccess struct {
+	file     string
+	fileType string
+
+	lastAccess time.Time
+	hits       int64
+}
+
+type storageEntry struct {
+	file     string
+	fileType string
+	size     int
+
+	lastAccess time.Time
+	hits       int64
+}
+
+// storageLister is implemented by backends that can list their entries.
+type storageLister interface {
+	entries() ([]storageEntry, error)
+}
+
+// storageEvictor is implemented by backends that track accesses and can
+// list their entries, which the evictor and the scrubber need.
+type storageEvictor interface {
+	storageLister
+	recordAccesses(accesses []storageAccess) error
+}
+
+// storageCompactor is implemented by backends that don't give the space of
+// deleted entries back on their own.
+type storageCompactor interface {
+	compact() error
+}
+
+// accessTracker collects accesses in memory, so serving never waits for the
+// backend. They are written in batches by the evictor, without an evictor
+// the tracker stays disabled and drops them.
+type accessTracker struct {
+	mutex    sync.Mutex
+	enabled  bool
+	accesses map[memoryKey]*storageAccess
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{
+		accesses: map[memoryKey]*storageAccess{},
+	}
+}
+
+func (tracker *accessTracker) record(fileID string, fileType string) {
+	key := memoryKey{fileID, fileType}
+	now := time.Now().UTC()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if !tracker.enabled {
+		return
+	}
+
+	access, ok := tracker.accesses[key]
+	if !ok {
+		access = &storageAccess{
+			file:     fileID,
+			fileType: fileType,
+		}
+		tracker.accesses[key] = access
+	}
+
+	access.lastAccess = now
+	access.hits++
+}
+
+func (tracker *accessTracker) enable() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.enabled = true
+}
+
+func (tracker *accessTracker) take() []storageAccess {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	accesses := make([]storageAccess, 0, len(tracker.accesses))
+	for _, access := range tracker.accesses {
+		accesses = append(accesses, *access)
+	}
+	tracker.accesses = map[memoryKey]*storageAccess{}
+
+	return accesses
+}
+
+func checkEvictPolicy(policy string) error {
+	switch policy {
+	case "", evictPolicyLRU, evictPolicyLFU:
+		return nil
+	}
+
+	return fmt.Errorf("unknown eviction policy: %v", policy)
+}
+
+func (app *app) initEvictor(config CacheConfig) {
+	if _, ok := app.storage.(storageEvictor); !ok {
+		if config.MaxBytes > 0 {
+			log.Printf("[initEvictor] the %v backend can't evict, MaxBytes is ignored", config.Backend)
+		}
+		return
+	}
+	if config.EvictInterval <= 0 {
+		return
+	}
+
+	app.accesses.enable()
+
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+
+		ticker := time.NewTicker(config.EvictInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.done:
+				app.flushAccesses()
+				return
+			case <-ticker.C:
+			}
+
+			app.flushAccesses()
+
+			if config.MaxBytes > 0 {
+				if err := app.evict(config); err != nil {
+					log.Printf("[evict] %v", err)
+				}
+			}
+
+			app.compact()
+		}
+	}()
+}
+
+// recordAccess counts an access of a served entry. Serving a variant also
+// counts for its raw file, which is needed to revalidate the variant.
+func (app *app) recordAccess(served *file) {
+	app.accesses.record(served.file, served.fileType)
+
+	if served.fileType != "uncompressed" {
+		app.accesses.record(served.file, "uncompressed")
+	}
+}
+
+// compact gives the space of evicted and deleted entries back.
+func (app *app) compact() {
+	compactor, ok := app.storage.(storageCompactor)
+	if !ok {
+		return
+	}
+
+	if err := compactor.compact(); err != nil {
+		log.Printf("[compact] %v", err)
+	}
+}
+
+func (app *app) flushAccesses() {
+	evictor, ok := app.storage.(storageEvictor)
+	if !ok {
+		return
+	}
+
+	accesses := app.accesses.take()
+	if len(accesses) == 0 {
+		return
+	}
+
+	if err := evictor.recordAccesses(accesses); err != nil {
+		log.Printf("[flushAccesses] couldn't record %v accesses: %v", len(accesses), err)
+	}
+}
+
+// evict deletes entries until the cache is 10% below MaxBytes. Derived files
+// go first since they can be regenerated without upstream, then raw files.
+func (app *app) evict(config CacheConfig) error {
+	evictor := app.storage.(storageEvictor)
+
+	entries, err := evictor.entries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += int64(entry.size)
+	}
+	if total <= config.MaxBytes {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		aRaw, bRaw := a.fileType == "uncompressed", b.fileType == "uncompressed"
+		if aRaw != bRaw {
+			return bRaw
+		}
+
+		if config.EvictPolicy == evictPolicyLFU && a.hits != b.hits {
+			return a.hits < b.hits
+		}
+
+		return a.lastAccess.Before(b.lastAccess)
+	})
+
+	target := config.MaxBytes - config.MaxBytes/10
+	evicted := 0
+
+	for _, entry := range entries {
+		if total <= target {
+			break
+		}
+
+		select {
+		case <-app.done:
+			return nil
+		default:
+		}
+
+		if err := app.deleteFileFromCache(entry.file, entry.fileType); err != nil {
+			return err
+		}
+
+		total -= int64(entry.size)
+		evicted++
+	}
+
+	log.Printf("[evict] evicted %v entries, %v bytes left", evicted, total)
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package gw2imageserver
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAccessesNeedAnEvictor(t *testing.T) {
+	app := newTestApp(t, nil)
+
+	app.recordAccess(testFile("1", "png", nil))
+	if accesses := app.accesses.take(); len(accesses) != 0 {
+		t.Fatalf("tracked %v accesses without an evictor", len(accesses))
+	}
+}
+
+func TestServedVariantsCountForTheirRawFile(t *testing.T) {
+	app := newTestApp(t, func(config *Config) {
+		config.Cache.EvictInterval = time.Hour
+	})
+	app.initEvictor(app.cacheConfig)
+
+	app.recordAccess(testFile("1", "png", nil))
+
+	var types []string
+	for _, access := range app.accesses.take() {
+		types = append(types, access.file+" "+access.fileType)
+	}
+	sort.Strings(types)
+
+	if len(types) != 2 || types[0] != "1 png" || types[1] != "1 uncompressed" {
+		t.Fatalf("got accesses %v", types)
+	}
+}
@@ -0,0 +1,363 @@
+package gw2imageserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/ptolstoi/gw2imageserver/internal/datFile"
+	"github.com/ptolstoi/gw2imageserver/internal/textureInflater"
+)
+
+const exportIndexName = "index.json"
+
+type ExportConfig struct {
+	Directory string
+	Workers   int
+}
+
+type exportEntry struct {
+	BaseID  uint32 `json:"baseId"`
+	FileID  uint32 `json:"fileId"`
+	Variant string `json:"variant"`
+	FourCC  string `json:"fourCC"`
+	Format  string `json:"format"`
+	Width   uint16 `json:"width"`
+	Height  uint16 `json:"height"`
+	File    string `json:"file"`
+}
+
+type exportFailure struct {
+	BaseID uint32 `json:"baseId"`
+	FileID uint32 `json:"fileId"`
+	Error  string `json:"error"`
+}
+
+type exportIndex struct {
+	Textures []exportEntry   `json:"textures"`
+	Failures []exportFailure `json:"failures"`
+	Skipped  []uint32        `json:"skipped"`
+}
+
+type exportJob struct {
+	baseID uint32
+	fileID uint32
+
+	archiveEntry *datFile.Entry
+}
+
+type exportResult struct {
+	job exportJob
+
+	entry   *exportEntry
+	skipped bool
+	err     error
+}
+
+// Export decodes every texture of the archive, or of the manifest if no
+// archive is configured, into PNGs plus an index. Entries already listed in
+// an existing index are skipped, so an interrupted export can be resumed.
+func Export(config Config, exportConfig ExportConfig) error {
+	app, err := newApp(config)
+	if err != nil {
+		return err
+	}
+	defer app.closeArchive()
+
+	if exportConfig.Workers < 1 {
+		exportConfig.Workers = 1
+	}
+
+	if err := os.MkdirAll(exportConfig.Directory, 0755); err != nil {
+		return err
+	}
+
+	jobs, err := app.exportJobs()
+	if err != nil {
+		return err
+	}
+
+	index, err := loadExportIndex(exportConfig.Directory)
+	if err != nil {
+		return err
+	}
+
+	done := map[uint32]bool{}
+	for _, entry := range index.Textures {
+		if _, err := os.Stat(filepath.Join(exportConfig.Directory, entry.File)); err == nil {
+			done[entry.FileID] = true
+		}
+	}
+	for _, fileID := range index.Skipped {
+		done[fileID] = true
+	}
+
+	// failures and lost PNGs are retried
+	index.Failures = nil
+	textures := index.Textures[:0]
+	for _, entry := range index.Textures {
+		if done[entry.FileID] {
+			textures = append(textures, entry)
+		}
+	}
+	index.Textures = textures
+
+	var pending []exportJob
+	for _, job := range jobs {
+		if !done[job.fileID] {
+			pending = append(pending, job)
+		}
+	}
+
+	log.Printf("[Export] %v entries, %v already exported, %v pending", len(jobs), len(jobs)-len(pending), len(pending))
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	jobChannel := make(chan exportJob)
+	resultChannel := make(chan exportResult)
+
+	// stop releases the workers if Export returns early
+	stop := make(chan struct{})
+
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	defer close(stop)
+
+	for i := 0; i < exportConfig.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobChannel {
+				select {
+				case resultChannel <- app.exportTextureSafely(exportConfig.Directory, job):
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobChannel)
+		for _, job := range pending {
+			select {
+			case jobChannel <- job:
+			case <-interrupt:
+				log.Printf("[Export] interrupted, waiting for running jobs")
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		workers.Wait()
+		close(resultChannel)
+	}()
+
+	processed := 0
+	for result := range resultChannel {
+		processed++
+
+		if result.err != nil {
+			log.Printf("[Export] %v/%v failed: %v", result.job.baseID, result.job.fileID, result.err)
+			index.Failures = append(index.Failures, exportFailure{
+				BaseID: result.job.baseID,
+				FileID: result.job.fileID,
+				Error:  result.err.Error(),
+			})
+		} else if result.skipped {
+			index.Skipped = append(index.Skipped, result.job.fileID)
+		} else {
+			index.Textures = append(index.Textures, *result.entry)
+		}
+
+		if processed%500 == 0 {
+			log.Printf("[Export] %v/%v processed", processed, len(pending))
+			if err := saveExportIndex(exportConfig.Directory, index); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := saveExportIndex(exportConfig.Directory, index); err != nil {
+		return err
+	}
+
+	log.Printf("[Export] processed=%v textures=%v skipped=%v failures=%v", processed, len(index.Textures), len(index.Skipped), len(index.Failures))
+
+	return nil
+}
+
+func (app *app) exportJobs() ([]exportJob, error) {
+	var jobs []exportJob
+
+	if app.archive != nil {
+		for _, entry := range app.archive.Entries() {
+			entry := entry
+			jobs = append(jobs, exportJob{
+				baseID: entry.BaseID,
+				fileID: entry.FileID,
+
+				archiveEntry: &entry,
+			})
+		}
+
+		return jobs, nil
+	}
+
+	if len(app.sources) == 0 {
+		return nil, fmt.Errorf("nothing to export from, configure an archive or upstream")
+	}
+
+	if err := app.refreshManifest(); err != nil {
+		return nil, err
+	}
+
+	for baseID, entry := range app.manifest.manifest.entries {
+		jobs = append(jobs, exportJob{
+			baseID: baseID,
+			fileID: entry.fileID,
+		})
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].baseID < jobs[j].baseID
+	})
+
+	return jobs, nil
+}
+
+// exportTextureSafely reports a panic while decoding as a failure of the job,
+// instead of ending the whole export.
+func (app *app) exportTextureSafely(directory string, job exportJob) (result exportResult) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("[Export] panic in %v/%v: %v\n%s", job.baseID, job.fileID, recovered, debug.Stack())
+			result = exportResult{
+				job: job,
+				err: fmt.Errorf("panic: %v", recovered),
+			}
+		}
+	}()
+
+	return app.exportTexture(directory, job)
+}
+
+func (app *app) exportTexture(directory string, job exportJob) exportResult {
+	result := exportResult{
+		job: job,
+	}
+
+	var data []byte
+	if job.archiveEntry != nil {
+		data, result.err = app.archive.Read(*job.archiveEntry)
+	} else {
+		var fetched *file
+		fetched, result.err = app.fetchFile(strconv.FormatUint(uint64(job.fileID), 10), priorityBackground, nil)
+		if fetched != nil {
+			data = fetched.content
+		}
+	}
+	if result.err != nil {
+		return result
+	}
+
+	if len(data) < 4 || !isTextureFourCC(string(data[0:4])) {
+		result.skipped = true
+		return result
+	}
+
+	imgRaw, info, err := decodeTexture(data)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	content, err := encodePNG(&imgRaw)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	name := fmt.Sprintf("%v.png", job.fileID)
+	if err := writeFileAtomic(filepath.Join(directory, name), content); err != nil {
+		result.err = err
+		return result
+	}
+
+	format := "DXT1"
+	if info.format == textureInflater.FccDXT5 {
+		format = "DXT5"
+	}
+
+	result.entry = &exportEntry{
+		BaseID:  job.baseID,
+		FileID:  job.fileID,
+		Variant: "png",
+		FourCC:  info.fourCC,
+		Format:  format,
+		Width:   info.width,
+		Height:  info.height,
+		File:    name,
+	}
+
+	return result
+}
+
+func loadExportIndex(directory string) (*exportIndex, error) {
+	index := exportIndex{}
+
+	data, err := ioutil.ReadFile(filepath.Join(directory, exportIndexName))
+	if os.IsNotExist(err) {
+		return &index, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("couldn't read %v: %v", exportIndexName, err)
+	}
+
+	return &index, nil
+}
+
+func saveExportIndex(directory string, index *exportIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(directory, exportIndexName), data)
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := temp.Write(content); err != nil {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		_ = os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
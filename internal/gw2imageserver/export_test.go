@@ -0,0 +1,22 @@
+package gw2imageserver
+
+import (
+	"testing"
+
+	"github.com/ptolstoi/gw2imageserver/internal/datFile"
+)
+
+func TestExportTextureRecoversPanics(t *testing.T) {
+	app := &app{}
+
+	// without an archive reading the entry panics
+	result := app.exportTextureSafely(t.TempDir(), exportJob{
+		baseID:       1,
+		fileID:       2,
+		archiveEntry: &datFile.Entry{FileID: 2},
+	})
+
+	if result.err == nil || result.job.fileID != 2 {
+		t.Fatalf("want a failure of job 2, got %+v", result)
+	}
+}
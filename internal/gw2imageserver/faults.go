@@ -0,0 +1,165 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type FaultConfig struct {
+	Enabled bool `json:"enabled"`
+
+	LatencyProbability float64 `json:"latencyProbability"`
+	LatencyMs          int     `json:"latencyMs"`
+
+	ErrorProbability float64 `json:"errorProbability"`
+	ErrorStatus      int     `json:"errorStatus"`
+
+	TruncateProbability float64 `json:"truncateProbability"`
+	BitFlipProbability  float64 `json:"bitFlipProbability"`
+	ResetProbability    float64 `json:"resetProbability"`
+}
+
+type faultTransport struct {
+	mutex  sync.RWMutex
+	config FaultConfig
+
+	next http.RoundTripper
+}
+
+type truncatedReader struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (reader *truncatedReader) Read(p []byte) (int, error) {
+	if reader.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+
+	n, err := reader.reader.Read(p)
+	reader.remaining -= n
+
+	return n, err
+}
+
+func newFaultTransport(config FaultConfig, next http.RoundTripper) *faultTransport {
+	return &faultTransport{
+		config: config,
+		next:   next,
+	}
+}
+
+func (transport *faultTransport) getConfig() FaultConfig {
+	transport.mutex.RLock()
+	defer transport.mutex.RUnlock()
+
+	return transport.config
+}
+
+func (transport *faultTransport) setConfig(config FaultConfig) error {
+	for _, probability := range []float64{
+		config.LatencyProbability,
+		config.ErrorProbability,
+		config.TruncateProbability,
+		config.BitFlipProbability,
+		config.ResetProbability,
+	} {
+		if probability < 0 || probability > 1 {
+			return fmt.Errorf("probabilities must be between 0 and 1")
+		}
+	}
+	if config.ErrorStatus == 0 {
+		config.ErrorStatus = http.StatusServiceUnavailable
+	}
+
+	transport.mutex.Lock()
+	transport.config = config
+	transport.mutex.Unlock()
+
+	log.Printf("[faults] %+v", config)
+
+	return nil
+}
+
+func roll(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+func (transport *faultTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	config := transport.getConfig()
+	if !config.Enabled {
+		return transport.next.RoundTrip(request)
+	}
+
+	if roll(config.LatencyProbability) {
+		log.Printf("[faults] delaying %v by %vms", request.URL, config.LatencyMs)
+		time.Sleep(time.Duration(config.LatencyMs) * time.Millisecond)
+	}
+
+	if roll(config.ResetProbability) {
+		log.Printf("[faults] resetting connection for %v", request.URL)
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+
+	if roll(config.ErrorProbability) {
+		log.Printf("[faults] answering %v with %v", request.URL, config.ErrorStatus)
+		return &http.Response{
+			Status:     http.StatusText(config.ErrorStatus),
+			StatusCode: config.ErrorStatus,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    request,
+		}, nil
+	}
+
+	response, err := transport.next.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	truncate := roll(config.TruncateProbability)
+	bitFlip := roll(config.BitFlipProbability)
+	if !truncate && !bitFlip {
+		return response, nil
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if bitFlip && len(body) > 0 {
+		position := rand.Intn(len(body))
+		log.Printf("[faults] flipping a bit at %v of %v", position, request.URL)
+		body[position] ^= 1 << uint(rand.Intn(8))
+	}
+
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if truncate && len(body) > 0 {
+		length := rand.Intn(len(body))
+		log.Printf("[faults] truncating %v to %v of %v bytes", request.URL, length, len(body))
+		response.Body = ioutil.NopCloser(&truncatedReader{
+			reader:    bytes.NewReader(body),
+			remaining: length,
+		})
+	}
+
+	return response, nil
+}
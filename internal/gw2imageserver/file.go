@@ -5,12 +5,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
+	"image/jpeg"
 	"image/png"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"time"
 
+	"github.com/ptolstoi/gw2imageserver/internal/datInflater"
 	"github.com/ptolstoi/gw2imageserver/internal/textureInflater"
 )
 
@@ -35,96 +35,262 @@ type file struct {
 	content      []byte
 	fileType     string
 	lastModified time.Time
+
+	// size and hex SHA-256 of content, also known for metadata-only lookups
+	size int
+	hash string
+
+	// validators of the upstream response a raw file came from
+	etag             string
+	upstreamModified string
+
+	// how a variant was generated from its raw file
+	derivation derivation
 }
 
-func (app *app) fetchFile(fileID string) (*file, error) {
+// fetchFile asks every source for fileID. If cached is given and still
+// current, cached itself is returned.
+func (app *app) fetchFile(fileID string, prio priority, cached *file) (*file, error) {
 	// https://render.guildwars2.com/file/BFD2CB5A0604A4425DF9CD22DF0F40C4E0AE9AAA/602790.jpg
 	// https://render.guildwars2.com/file/BFD2CB5A0604A4425DF9CD22DF0F40C4E0AE9AAA/602790.png
 	// http://assetcdn.101.arenanetworks.com/program/101/1/0/602790
 	// authCookie=access=/latest/*!/manifest/program/*!/program/*~md5=4e51ad868f87201ad93e428ff30c6691
-	url := fmt.Sprintf("http://assetcdn.101.ArenaNetworks.com/program/101/1/0/%v", fileID)
+	var lastErr error
+
+	for _, source := range app.sources {
+		log.Printf("[fetchFile] fetching %v from %v", fileID, source.name())
+
+		fetched, err := source.fetch(fileID, prio, cached)
+		if err != nil {
+			log.Printf("[fetchFile] %v: %v", source.name(), err)
+			lastErr = err
+			continue
+		} else if fetched == nil {
+			continue
+		}
+
+		if fetched.notModified && cached != nil {
+			log.Printf("[fetchFile] %v not modified", fileID)
+			return cached, nil
+		}
 
-	log.Printf("[fetchFile] fetching %v", url)
+		// sources without validators, like the archive, always send the content
+		if cached != nil && fetched.content != nil && cached.hash == contentHash(fetched.content) &&
+			cached.etag == fetched.etag && cached.upstreamModified == fetched.upstreamModified {
+			log.Printf("[fetchFile] %v unchanged", fileID)
+			return cached, nil
+		}
+
+		file := file{
+			file:         fileID,
+			fileType:     "uncompressed",
+			lastModified: time.Now().UTC(),
+			content:      fetched.content,
+
+			etag:             fetched.etag,
+			upstreamModified: fetched.upstreamModified,
+		}
+
+		return &file, nil
+	}
 
-	request, err := http.NewRequest("GET", url, nil)
+	return nil, lastErr
+}
+
+// unwrapTexture inflates data that arrived in ArenaNet's archive compression
+// instead of as a bare texture. Anything else is returned unchanged.
+func unwrapTexture(data []byte) []byte {
+	if checkHeader(data) == nil {
+		return data
+	}
+
+	inflated, err := datInflater.Inflate(data, 0)
 	if err != nil {
-		return nil, err
+		log.Printf("[unwrapTexture] not compressed: %v", err)
+		return data
 	}
-	request.AddCookie(&http.Cookie{
-		Name:  "authCookie",
-		Value: "access=/latest/*!/manifest/program/*!/program/*~md5=4e51ad868f87201ad93e428ff30c6691",
+
+	if err := checkHeader(inflated); err != nil {
+		log.Printf("[unwrapTexture] inflated %v to %v bytes, but: %v", len(data), len(inflated), err)
+		return data
+	}
+
+	log.Printf("[unwrapTexture] inflated %v to %v bytes", len(data), len(inflated))
+
+	return inflated
+}
+
+func (app *app) getUncompressedFile(fileID string, refresh bool, policy cachePolicy) (*file, error) {
+	return app.inflight.do(fileID, "uncompressed", func() (*file, error) {
+		cachedFile, err := app.getFileFromCache(fileID, "uncompressed")
+		if err != nil {
+			return nil, err
+		}
+
+		if policy == cachePolicyCacheOnly || (cachedFile != nil && !refresh) {
+			return cachedFile, nil
+		}
+
+		uncompressedFile, err := app.revalidateFile(fileID, cachedFile, priorityInteractive)
+		if err != nil && cachedFile != nil {
+			log.Printf("[getUncompressedFile] upstream failed, using stale file=%v: %v", fileID, err)
+			return cachedFile, nil
+		}
+
+		return uncompressedFile, err
 	})
+}
 
-	response, err := app.httpClient.Do(request)
+// revalidateFile fetches the raw file, conditionally if cached is given. A
+// changed raw file replaces the cached one and drops all files derived from it.
+func (app *app) revalidateFile(fileID string, cached *file, prio priority) (*file, error) {
+	uncompressedFile, err := app.fetchFile(fileID, prio, cached)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = response.Body.Close() }()
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+	if uncompressedFile == nil && cached == nil {
+		return nil, nil
 	}
 
-	file := file{
-		file:         fileID,
-		fileType:     "uncompressed",
-		lastModified: time.Now().UTC(),
-		content:      body,
+	now := time.Now().UTC()
+
+	// cached may be shared with coalesced callers, touch a copy
+	if uncompressedFile == nil || uncompressedFile == cached {
+		touched := *cached
+		touched.lastModified = now
+		if err := app.touchFileInCache(&touched); err != nil {
+			return nil, err
+		}
+
+		if uncompressedFile == nil {
+			log.Printf("[revalidateFile] no source has %v anymore, keeping the cached file", fileID)
+		} else {
+			app.recordRevision(&touched, now)
+		}
+
+		return &touched, nil
 	}
 
-	return &file, nil
-}
+	if err := app.saveFileToCache(uncompressedFile); err != nil {
+		return nil, err
+	}
+	app.recordRevision(uncompressedFile, now)
 
-func (app *app) noImageFileInCache(fileID string, fileType string) (*file, error) {
-	uncompressedFile, err := app.getFileFromCache(fileID, "uncompressed")
+	return uncompressedFile, nil
+}
 
-	if uncompressedFile == nil && err == nil {
-		uncompressedFile, err = app.fetchFile(fileID)
+// revalidateRaw revalidates the raw source of fileID and reports whether it
+// changed. A raw file that isn't cached anymore counts as changed. It shares
+// getUncompressedFile's calls, so both never write the raw file at once.
+func (app *app) revalidateRaw(fileID string, prio priority) (bool, error) {
+	cached, err := app.getFileMetadataFromCache(fileID, "uncompressed")
+	if err != nil || cached == nil {
+		return cached == nil && err == nil, err
+	}
 
-		if err == nil && uncompressedFile != nil {
-			err = app.saveFileToCache(uncompressedFile)
+	revalidated, err := app.inflight.do(fileID, "uncompressed", func() (*file, error) {
+		// waiters of getUncompressedFile need the content
+		current, err := app.getFileFromCache(fileID, "uncompressed")
+		if err != nil || current == nil {
+			return nil, err
 		}
+
+		return app.revalidateFile(fileID, current, prio)
+	})
+	if err != nil {
+		return false, err
 	}
+
+	return revalidated == nil || revalidated.hash != cached.hash, nil
+}
+
+func (app *app) noImageFileInCache(fileID string, fileType string, refresh bool, policy cachePolicy) (*file, error) {
+	return app.inflight.do(fileID, fileType, func() (*file, error) {
+		return app.createImageFile(fileID, fileType, refresh, policy)
+	})
+}
+
+func (app *app) createImageFile(fileID string, fileType string, refresh bool, policy cachePolicy) (*file, error) {
+	uncompressedFile, err := app.getUncompressedFile(fileID, refresh, policy)
 	if err != nil {
 		return nil, err
+	} else if uncompressedFile == nil {
+		return nil, nil
 	}
 
-	data := uncompressedFile.content
-
 	log.Printf("[noFileInCache] file found: file=%v type=%v length=%v lastModified=%v", uncompressedFile.file, uncompressedFile.fileType, len(uncompressedFile.content), uncompressedFile.lastModified)
 	// log.Printf("\n%s", hex.Dump(data[0:(16*10)]))
 
-	if err := checkHeader(data); err != nil {
+	return app.createVariant(fileID, fileType, uncompressedFile)
+}
+
+// createVariant builds and caches the fileType variant of a raw file under
+// fileID.
+func (app *app) createVariant(fileID string, fileType string, uncompressedFile *file) (*file, error) {
+	data := uncompressedFile.content
+
+	imgRaw, info, err := decodeTexture(data)
+	if err != nil {
 		return nil, err
 	}
 
-	format := string(data[4:8])
-	width := binary.LittleEndian.Uint16(data[8:10])
-	height := binary.LittleEndian.Uint16(data[10:12])
-	numBlocks := uint32((width+3)>>2) * uint32((height+3)>>2)
+	sourceHash := uncompressedFile.hash
+	if sourceHash == "" {
+		sourceHash = contentHash(data)
+	}
+
+	derived := derivation{
+		SourceSHA256:   sourceHash,
+		DecoderVersion: decoderVersion,
+		EncodeOptions:  encodeOptions(fileType),
+		Width:          int(info.width),
+		Height:         int(info.height),
+	}
 
-	if format == textureInflater.FccDXT1 {
+	return app.saveImage(fileID, fileType, &imgRaw, derived)
+}
+
+type textureInfo struct {
+	fourCC string
+	format string
+	width  uint16
+	height uint16
+}
+
+func decodeTexture(data []byte) (image.Image, *textureInfo, error) {
+	if err := checkHeader(data); err != nil {
+		return nil, nil, err
+	}
+
+	info := textureInfo{
+		fourCC: string(data[0:4]),
+		format: string(data[4:8]),
+		width:  binary.LittleEndian.Uint16(data[8:10]),
+		height: binary.LittleEndian.Uint16(data[10:12]),
+	}
+	numBlocks := uint32((info.width+3)>>2) * uint32((info.height+3)>>2)
+
+	if info.format == textureInflater.FccDXT1 {
 		numBlocks *= 8
-	} else if format == textureInflater.FccDXT5 {
+	} else if info.format == textureInflater.FccDXT5 {
 		numBlocks *= 16
 	} else {
-		return nil, fmt.Errorf("unknown ATEX texture format: %v", format)
+		return nil, nil, fmt.Errorf("unknown ATEX texture format: %v", info.format)
 	}
 
-	//log.Printf("width: %v, height: %v, format: %v, numBlocks: %v", width, height, format, numBlocks)
-
-	imgRaw, err := textureInflater.Inflate(data, width, height)
+	//log.Printf("width: %v, height: %v, format: %v, numBlocks: %v", info.width, info.height, info.format, numBlocks)
 
+	imgRaw, err := textureInflater.Inflate(data, info.width, info.height)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if fileType == "png" {
-		return app.saveImageAsPNG(fileID, &imgRaw)
-	}
+	return imgRaw, &info, nil
+}
 
-	return nil, fmt.Errorf("unknown file type")
+func isTextureFourCC(fourCC string) bool {
+	return fourCC == fccATEX || fourCC == fccATTX || fourCC == fccATEP || fourCC == fccATEU || fourCC == fccATEC || fourCC == fccATET
 }
 
 func checkHeader(data []byte) error {
@@ -134,7 +300,7 @@ func checkHeader(data []byte) error {
 
 	fourCC := string(data[0:4])
 
-	if fourCC != fccATEX && fourCC != fccATTX && fourCC != fccATEP && fourCC != fccATEU && fourCC != fccATEC && fourCC != fccATET {
+	if !isTextureFourCC(fourCC) {
 		return fmt.Errorf("unknown format: %v", fourCC)
 	}
 
@@ -147,7 +313,7 @@ func checkHeader(data []byte) error {
 	return nil
 }
 
-func (app *app) saveImageAsPNG(fileID string, imgRaw *image.Image) (*file, error) {
+func encodePNG(imgRaw *image.Image) ([]byte, error) {
 	buffer := new(bytes.Buffer)
 
 	encoder := png.Encoder{
@@ -158,11 +324,43 @@ func (app *app) saveImageAsPNG(fileID string, imgRaw *image.Image) (*file, error
 		return nil, err
 	}
 
+	return buffer.Bytes(), nil
+}
+
+// encodeJPEG matches render.guildwars2.com's .jpg URLs. Transparent pixels
+// turn black.
+func encodeJPEG(imgRaw *image.Image) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+
+	if err := jpeg.Encode(buffer, *imgRaw, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (app *app) saveImage(fileID string, fileType string, imgRaw *image.Image, derived derivation) (*file, error) {
+	var content []byte
+	var err error
+
+	switch fileType {
+	case "png":
+		content, err = encodePNG(imgRaw)
+	case "jpg":
+		content, err = encodeJPEG(imgRaw)
+	default:
+		return nil, fmt.Errorf("unknown file type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	newFile := file{
-		content:      buffer.Bytes(),
+		content:      content,
 		file:         fileID,
 		lastModified: time.Now().UTC(),
-		fileType:     "png",
+		fileType:     fileType,
+		derivation:   derived,
 	}
 
 	if err := app.saveFileToCache(&newFile); err != nil {
@@ -0,0 +1,160 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staticSource answers every request with content, without validators.
+type staticSource struct {
+	content []byte
+}
+
+func (source *staticSource) name() string {
+	return "static"
+}
+
+func (source *staticSource) fetch(string, priority, *file) (*fetchedTexture, error) {
+	return &fetchedTexture{content: source.content}, nil
+}
+
+func hasVariant(t *testing.T, app *app, fileID string) bool {
+	t.Helper()
+
+	variant, err := app.getFileMetadataFromCache(fileID, "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return variant != nil
+}
+
+func TestRefreshKeepsFilesGoneUpstream(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	app := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+	})
+
+	lookupPNG(t, app, "1", cachePolicyCacheFirst)
+	upstream.remove("1")
+
+	changed, err := app.refreshEntry("1", "png", priorityInteractive)
+	if err != nil || changed {
+		t.Fatalf("got changed=%v, %v, want an unchanged entry", changed, err)
+	}
+	if !hasVariant(t, app, "1") {
+		t.Fatal("the variant was dropped")
+	}
+
+	raw, err := app.getFileFromCache("1", "uncompressed")
+	if err != nil || raw == nil {
+		t.Fatalf("the raw file was dropped: %v", err)
+	}
+}
+
+func TestRefreshKeepsVariantsOfUnchangedContent(t *testing.T) {
+	source := &staticSource{content: testTexture(0xf800f800)}
+
+	app := newTestApp(t, nil)
+	app.sources = []textureSource{source}
+
+	lookupPNG(t, app, "1", cachePolicyCacheFirst)
+
+	changed, err := app.refreshEntry("1", "png", priorityInteractive)
+	if err != nil || changed {
+		t.Fatalf("got changed=%v, %v, want an unchanged entry", changed, err)
+	}
+	if !hasVariant(t, app, "1") {
+		t.Fatal("the variant of unchanged content was dropped")
+	}
+
+	source.content = testTexture(0x001f001f)
+
+	changed, err = app.refreshEntry("1", "png", priorityInteractive)
+	if err != nil || !changed {
+		t.Fatalf("got changed=%v, %v, want a changed entry", changed, err)
+	}
+	if hasVariant(t, app, "1") {
+		t.Fatal("the variant of changed content was kept")
+	}
+}
+
+// blockingSource answers like staticSource once release is closed, and
+// signals every fetch on started.
+type blockingSource struct {
+	staticSource
+	started chan struct{}
+	release chan struct{}
+	fetches int32
+}
+
+func (source *blockingSource) fetch(fileID string, prio priority, cached *file) (*fetchedTexture, error) {
+	atomic.AddInt32(&source.fetches, 1)
+	source.started <- struct{}{}
+	<-source.release
+
+	return source.staticSource.fetch(fileID, prio, cached)
+}
+
+func waitForWaiters(t *testing.T, app *app, fileID string, fileType string, waiters int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		app.inflight.mutex.Lock()
+		call, ok := app.inflight.calls[coalesceKey(fileID, fileType)]
+		joined := ok && call.waiters >= waiters
+		app.inflight.mutex.Unlock()
+
+		if joined {
+			return
+		}
+	}
+
+	t.Fatalf("nobody joined the call for %v %v", fileID, fileType)
+}
+
+func TestRefreshSharesInteractiveFetches(t *testing.T) {
+	app := newTestApp(t, nil)
+	if err := app.saveFileToCache(testFile("1", "uncompressed", testTexture(0xf800f800))); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &blockingSource{
+		staticSource: staticSource{content: testTexture(0x001f001f)},
+		started:      make(chan struct{}, 2),
+		release:      make(chan struct{}),
+	}
+	app.sources = []textureSource{source}
+
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := app.refreshEntry("1", "uncompressed", priorityBackground)
+		refreshed <- err
+	}()
+	<-source.started
+
+	fetched := make(chan *file, 1)
+	go func() {
+		raw, err := app.getUncompressedFile("1", true, cachePolicyCacheFirst)
+		if err != nil {
+			t.Error(err)
+		}
+		fetched <- raw
+	}()
+	waitForWaiters(t, app, "1", "uncompressed", 1)
+	close(source.release)
+
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+	if raw := <-fetched; raw == nil || !bytes.Equal(raw.content, source.content) {
+		t.Fatalf("got %+v, want the refreshed content", raw)
+	}
+	if fetches := atomic.LoadInt32(&source.fetches); fetches != 1 {
+		t.Fatalf("got %v fetches, want one shared", fetches)
+	}
+}
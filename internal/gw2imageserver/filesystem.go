@@ -0,0 +1,601 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filesystemStorage stores content-addressed blobs under blobs/ and one JSON
+// sidecar per file under index/<file>/<fileType>.json pointing at its blob.
+// The revisions of raw files are listed in revisions/<file>.json.
+// Every write is a rename, so the directory can be rsynced while serving.
+type filesystemStorage struct {
+	directory string
+
+	// mutex guards the sidecars, revisions and refs, refs counts sidecars and
+	// revisions per blob
+	mutex sync.Mutex
+	refs  map[string]int
+}
+
+type filesystemSidecar struct {
+	File         string    `json:"file"`
+	FileType     string    `json:"fileType"`
+	LastModified time.Time `json:"lastModified"`
+
+	ETag             string `json:"etag,omitempty"`
+	UpstreamModified string `json:"upstreamModified,omitempty"`
+
+	derivation
+
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+
+	LastAccess time.Time `json:"lastAccess"`
+	Hits       int64     `json:"hits"`
+}
+
+func newFilesystemStorage(directory string) (*filesystemStorage, error) {
+	storage := filesystemStorage{
+		directory: directory,
+		refs:      map[string]int{},
+	}
+
+	for _, dir := range []string{storage.blobDirectory(), storage.indexDirectory(), storage.revisionDirectory()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	var raws []*filesystemSidecar
+	err := storage.walkSidecars(func(sidecar *filesystemSidecar) {
+		storage.refs[sidecar.SHA256]++
+		if sidecar.FileType == "uncompressed" {
+			raws = append(raws, sidecar)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storage.countRevisions(raws); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[filesystemStorage] directory=%v blobs=%v", directory, len(storage.refs))
+
+	return &storage, nil
+}
+
+func (storage *filesystemStorage) blobDirectory() string {
+	return filepath.Join(storage.directory, "blobs")
+}
+
+func (storage *filesystemStorage) indexDirectory() string {
+	return filepath.Join(storage.directory, "index")
+}
+
+func (storage *filesystemStorage) revisionDirectory() string {
+	return filepath.Join(storage.directory, "revisions")
+}
+
+func (storage *filesystemStorage) blobPath(hash string) string {
+	return filepath.Join(storage.blobDirectory(), hash[0:2], hash)
+}
+
+// pathName escapes a file ID or type so it is a single, visible path element.
+func pathName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty name")
+	}
+
+	escaped := url.QueryEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+
+	return escaped, nil
+}
+
+func (storage *filesystemStorage) sidecarPath(fileID string, fileType string) (string, error) {
+	fileName, err := pathName(fileID)
+	if err != nil {
+		return "", err
+	}
+	typeName, err := pathName(fileType)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(storage.indexDirectory(), fileName, typeName+".json"), nil
+}
+
+func (storage *filesystemStorage) revisionPath(fileID string) (string, error) {
+	fileName, err := pathName(fileID)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(storage.revisionDirectory(), fileName+".json"), nil
+}
+
+func (storage *filesystemStorage) walkSidecars(fn func(sidecar *filesystemSidecar)) error {
+	return filepath.Walk(storage.indexDirectory(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		sidecar, err := readSidecar(path)
+		if err != nil {
+			log.Printf("[filesystemStorage] skipping %v: %v", path, err)
+			return nil
+		}
+
+		fn(sidecar)
+
+		return nil
+	})
+}
+
+func readSidecar(path string) (*filesystemSidecar, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	sidecar := filesystemSidecar{}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, fmt.Errorf("corrupt sidecar %v: %v", path, err)
+	}
+	if len(sidecar.SHA256) != sha256.Size*2 {
+		return nil, fmt.Errorf("corrupt sidecar %v: invalid hash", path)
+	}
+
+	return &sidecar, nil
+}
+
+func writeSidecar(path string, sidecar *filesystemSidecar) error {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+func (storage *filesystemStorage) readSidecar(fileID string, fileType string) (*filesystemSidecar, error) {
+	path, err := storage.sidecarPath(fileID, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	return readSidecar(path)
+}
+
+func (sidecar *filesystemSidecar) file() *file {
+	return &file{
+		file:         sidecar.File,
+		fileType:     sidecar.FileType,
+		lastModified: sidecar.LastModified,
+
+		size: sidecar.Size,
+		hash: sidecar.SHA256,
+
+		etag:             sidecar.ETag,
+		upstreamModified: sidecar.UpstreamModified,
+
+		derivation: sidecar.derivation,
+	}
+}
+
+func (storage *filesystemStorage) getMetadata(fileID string, fileType string) (*file, error) {
+	sidecar, err := storage.readSidecar(fileID, fileType)
+	if err != nil || sidecar == nil {
+		return nil, err
+	}
+
+	return sidecar.file(), nil
+}
+
+// openBlob reads the sidecar of an entry and opens its blob. Both happen under
+// the mutex, so a concurrent save or delete can't release the blob in between,
+// and an open blob stays readable when it's removed afterwards.
+func (storage *filesystemStorage) openBlob(fileID string, fileType string) (*filesystemSidecar, *os.File, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	sidecar, err := storage.readSidecar(fileID, fileType)
+	if err != nil || sidecar == nil {
+		return nil, nil, err
+	}
+
+	blob, err := os.Open(storage.blobPath(sidecar.SHA256))
+	if os.IsNotExist(err) {
+		log.Printf("[filesystemStorage] blob of %v %v is missing", fileID, fileType)
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return sidecar, blob, nil
+}
+
+func (storage *filesystemStorage) get(fileID string, fileType string) (*file, error) {
+	sidecar, blob, err := storage.openBlob(fileID, fileType)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+	defer func() { _ = blob.Close() }()
+
+	content, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	file := sidecar.file()
+	file.content = content
+
+	return file, nil
+}
+
+func (storage *filesystemStorage) open(fileID string, fileType string) (io.ReadCloser, error) {
+	_, blob, err := storage.openBlob(fileID, fileType)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func (storage *filesystemStorage) save(file *file) error {
+	path, err := storage.sidecarPath(file.file, file.fileType)
+	if err != nil {
+		return err
+	}
+
+	sidecar := filesystemSidecar{
+		File:         file.file,
+		FileType:     file.fileType,
+		LastModified: file.lastModified,
+
+		ETag:             file.etag,
+		UpstreamModified: file.upstreamModified,
+
+		derivation: file.derivation,
+
+		SHA256: file.hash,
+		Size:   len(file.content),
+
+		LastAccess: time.Now().UTC(),
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	// a blob shared with other entries is rewritten if it got corrupted
+	blobPath := storage.blobPath(sidecar.SHA256)
+	existing, err := ioutil.ReadFile(blobPath)
+	if os.IsNotExist(err) || (err == nil && !bytes.Equal(existing, file.content)) {
+		if existing != nil {
+			log.Printf("[filesystemStorage] repairing corrupt blob %v", sidecar.SHA256)
+		}
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(blobPath, file.content); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	previous, err := readSidecar(path)
+	if err != nil {
+		log.Printf("[filesystemStorage] replacing %v: %v", path, err)
+	}
+
+	if err := writeSidecar(path, &sidecar); err != nil {
+		return err
+	}
+
+	storage.refs[sidecar.SHA256]++
+	if previous != nil {
+		storage.release(previous.SHA256)
+	}
+
+	return nil
+}
+
+func (storage *filesystemStorage) touch(file *file) error {
+	path, err := storage.sidecarPath(file.file, file.fileType)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	sidecar, err := readSidecar(path)
+	if err != nil || sidecar == nil {
+		return err
+	}
+
+	sidecar.LastModified = file.lastModified
+
+	return writeSidecar(path, sidecar)
+}
+
+func (storage *filesystemStorage) recordAccesses(accesses []storageAccess) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	for _, access := range accesses {
+		path, err := storage.sidecarPath(access.file, access.fileType)
+		if err != nil {
+			continue
+		}
+
+		sidecar, err := readSidecar(path)
+		if err != nil {
+			return err
+		} else if sidecar == nil {
+			continue
+		}
+
+		if access.lastAccess.After(sidecar.LastAccess) {
+			sidecar.LastAccess = access.lastAccess
+		}
+		sidecar.Hits += access.hits
+
+		if err := writeSidecar(path, sidecar); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *filesystemStorage) entries() ([]storageEntry, error) {
+	var entries []storageEntry
+
+	err := storage.walkSidecars(func(sidecar *filesystemSidecar) {
+		entries = append(entries, storageEntry{
+			file:     sidecar.File,
+			fileType: sidecar.FileType,
+			size:     sidecar.Size,
+
+			lastAccess: sidecar.LastAccess,
+			hits:       sidecar.Hits,
+		})
+	})
+
+	return entries, err
+}
+
+func (storage *filesystemStorage) delete(fileID string, fileType string) error {
+	path, err := storage.sidecarPath(fileID, fileType)
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.remove(path)
+}
+
+func (storage *filesystemStorage) deleteDerived(fileID string) error {
+	rawPath, err := storage.sidecarPath(fileID, "uncompressed")
+	if err != nil {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(rawPath), "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if path == rawPath {
+			continue
+		}
+
+		if err := storage.remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes a sidecar and its blob if nothing else refers to it. Must
+// be called with the mutex held.
+func (storage *filesystemStorage) remove(path string) error {
+	sidecar, err := readSidecar(path)
+	if err != nil {
+		log.Printf("[filesystemStorage] removing %v: %v", path, err)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if sidecar != nil {
+		storage.release(sidecar.SHA256)
+	}
+
+	return nil
+}
+
+// release drops a reference to a blob and deletes it once unused. Must be
+// called with the mutex held.
+func (storage *filesystemStorage) release(hash string) {
+	storage.refs[hash]--
+	if storage.refs[hash] > 0 {
+		return
+	}
+
+	delete(storage.refs, hash)
+
+	if err := os.Remove(storage.blobPath(hash)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[filesystemStorage] couldn't remove blob %v: %v", hash, err)
+	}
+}
+
+func readRevisions(path string) (*revisionIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	revisions := revisionIndex{}
+	if err := json.Unmarshal(data, &revisions); err != nil {
+		return nil, fmt.Errorf("corrupt revisions %v: %v", path, err)
+	}
+
+	return &revisions, nil
+}
+
+// countRevisions adds the references of all revisions to refs. Raw files
+// from before revisions were kept become their first revision.
+func (storage *filesystemStorage) countRevisions(raws []*filesystemSidecar) error {
+	paths, err := filepath.Glob(filepath.Join(storage.revisionDirectory(), "*.json"))
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, path := range paths {
+		revisions, err := readRevisions(path)
+		if err != nil {
+			log.Printf("[filesystemStorage] skipping %v: %v", path, err)
+			continue
+		}
+
+		for _, revision := range revisions.Revisions {
+			storage.refs[revision.SHA256]++
+			known[revisions.File+"\x00"+revision.SHA256] = true
+		}
+	}
+
+	for _, raw := range raws {
+		if known[raw.File+"\x00"+raw.SHA256] {
+			continue
+		}
+
+		if err := storage.addRevision(raw.file(), raw.LastModified); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (storage *filesystemStorage) recordRevision(file *file, seen time.Time) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.addRevision(file, seen)
+}
+
+// addRevision must be called with the mutex held.
+func (storage *filesystemStorage) addRevision(file *file, seen time.Time) error {
+	path, err := storage.revisionPath(file.file)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := readRevisions(path)
+	if err != nil {
+		return err
+	} else if revisions == nil {
+		revisions = &revisionIndex{File: file.file}
+	}
+
+	added := revisions.record(file, seen)
+
+	data, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+
+	if added {
+		storage.refs[file.hash]++
+	}
+
+	return nil
+}
+
+func (storage *filesystemStorage) revisions(fileID string) ([]revision, error) {
+	path, err := storage.revisionPath(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := readRevisions(path)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	return stored.list(), nil
+}
+
+func (storage *filesystemStorage) getRevision(fileID string, number int) (*file, error) {
+	revisions, err := storage.revisions(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revision := range revisions {
+		if revision.number != number {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(storage.blobPath(revision.hash))
+		if os.IsNotExist(err) {
+			log.Printf("[filesystemStorage] blob of revision %v of %v is missing", number, fileID)
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &file{
+			file:         fileID,
+			fileType:     "uncompressed",
+			lastModified: revision.lastSeen,
+			content:      content,
+			size:         revision.size,
+			hash:         revision.hash,
+		}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,79 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFilesystemStorage(t *testing.T) *filesystemStorage {
+	storage, err := newFilesystemStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+func testFile(fileID string, fileType string, content []byte) *file {
+	return &file{
+		file:         fileID,
+		fileType:     fileType,
+		lastModified: time.Now().UTC(),
+		content:      content,
+		hash:         contentHash(content),
+	}
+}
+
+func TestFilesystemOpenWhileReplacing(t *testing.T) {
+	storage := newTestFilesystemStorage(t)
+	contents := [][]byte{[]byte("first"), []byte("second")}
+
+	if err := storage.save(testFile("1", "png", contents[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	var writer sync.WaitGroup
+	stop := make(chan struct{})
+
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err := storage.save(testFile("1", "png", contents[i%2])); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5000; i++ {
+		blob, err := storage.open("1", "png")
+		if err != nil {
+			t.Fatal(err)
+		} else if blob == nil {
+			t.Fatalf("open %v found no blob", i)
+		}
+
+		content, err := ioutil.ReadAll(blob)
+		_ = blob.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, contents[0]) && !bytes.Equal(content, contents[1]) {
+			t.Fatalf("open %v read %q", i, content)
+		}
+	}
+
+	close(stop)
+	writer.Wait()
+}
@@ -1,10 +1,16 @@
 package gw2imageserver
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ptolstoi/neversorrow"
 	"github.com/ptolstoi/neversorrow/errors"
@@ -16,45 +22,259 @@ var (
 
 func (app *app) initHTTP() {
 	app.AddRoute("GET", "/v1/image/:file", app.serveImage)
+	app.AddRoute("GET", "/file/:signature/:file", app.serveSignedImage)
+	app.AddRoute("GET", "/v1/status/upstream", app.serveUpstreamStatus)
+	app.AddRoute("GET", "/v1/status/manifest", app.serveManifestStatus)
+	app.AddRoute("GET", "/v1/status/cache", app.serveCacheStatus)
+
+	app.initRevisionHTTP()
+	app.initAdminHTTP()
 }
 
-func (app *app) serveImage(ctx neversorrow.Context) {
-	noCache := len(ctx.Request().URL.Query()["noCache"]) != 0
+func (app *app) serveManifestStatus(ctx neversorrow.Context) {
+	writeJSON(ctx, app.manifestStatus())
+}
+
+func (app *app) serveCacheStatus(ctx neversorrow.Context) {
+	writeJSON(ctx, app.memory.status())
+}
+
+func (app *app) serveUpstreamStatus(ctx neversorrow.Context) {
+	writeJSON(ctx, app.upstream.status())
+}
+
+func writeJSON(ctx neversorrow.Context, value interface{}) {
+	resp := ctx.ResponseWriter()
+	resp.Header().Set(contentType, "application/json")
+
+	if err := json.NewEncoder(resp).Encode(value); err != nil {
+		log.Printf("[writeJSON] %v", err)
+	}
+}
+
+func readJSON(ctx neversorrow.Context, value interface{}) bool {
+	if err := json.NewDecoder(ctx.Request().Body).Decode(value); err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest))
+		return false
+	}
 
-	parts := strings.SplitN(ctx.Params()["file"], ".", 2)
+	return true
+}
+
+func contentTypeOf(fileType string) string {
+	switch fileType {
+	case "png":
+		return "image/png"
+	case "jpg":
+		return "image/jpeg"
+	}
+
+	return "text/plain"
+}
+
+func splitFileParam(param string) (string, string) {
+	parts := strings.SplitN(param, ".", 2)
 	extension := "png"
 	if len(parts) > 1 {
 		extension = parts[1]
 	}
-	fileToServe := parts[0]
 
-	file, err := app.getFileFromCache(fileToServe, extension)
+	return parts[0], extension
+}
 
-	if err == nil && (file == nil || noCache) {
-		file, err = app.noImageFileInCache(fileToServe, extension)
+func (app *app) serveImage(ctx neversorrow.Context) {
+	fileID, extension := splitFileParam(ctx.Params()["file"])
+
+	fileID, number, pinned, err := splitRevision(fileID)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(err.Error(), http.StatusBadRequest))
+		return
+	} else if pinned {
+		app.serveRevision(ctx, fileID, number, extension)
+		return
+	}
+
+	app.serveFile(ctx, fileID, extension)
+}
+
+// serveSignedImage mirrors render.guildwars2.com's /file/<signature>/<id>.<ext>.
+func (app *app) serveSignedImage(ctx neversorrow.Context) {
+	signature := strings.ToUpper(ctx.Params()["signature"])
+	fileID, extension := splitFileParam(ctx.Params()["file"])
+
+	if !isSignature(signature) {
+		ctx.Error(errors.NewWithCode("invalid signature", http.StatusBadRequest))
+		return
 	}
 
+	signedFileID, err := app.signedFileID(signature, fileID)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("error during lookup of signature %v: %v", signature, err), http.StatusInternalServerError))
+		return
+	} else if signedFileID == "" {
+		ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+		return
+	}
+
+	app.serveFile(ctx, signedFileID, extension)
+}
+
+// signedFileID returns the ID in the URL, or the file an admin imported the
+// signature for if the file name isn't an ID. Requests never add to the
+// signatures, anyone can put any signature in front of any ID.
+func (app *app) signedFileID(signature string, fileID string) (string, error) {
+	if isFileID(fileID) {
+		return fileID, nil
+	}
+
+	return app.getFileBySignature(signature)
+}
+
+func isFileID(fileID string) bool {
+	_, err := strconv.ParseUint(fileID, 10, 32)
+	return err == nil
+}
+
+func isSignature(signature string) bool {
+	if len(signature) != 40 {
+		return false
+	}
+
+	for _, c := range signature {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestPolicy returns the cache policy for the request. Only admins may
+// override it with ?policy= or force a refetch with ?noCache.
+func (app *app) requestPolicy(ctx neversorrow.Context) (cachePolicy, bool, error) {
+	query := ctx.Request().URL.Query()
+	noCache := len(query["noCache"]) != 0
+	override := query.Get("policy")
+
+	if !noCache && override == "" {
+		return app.cachePolicy, false, nil
+	}
+
+	if !app.isAdmin(ctx) {
+		log.Printf("[requestPolicy] ignoring cache overrides of unprivileged request %v", ctx.Request().URL)
+		return app.cachePolicy, false, nil
+	}
+
+	if override == "" {
+		return app.cachePolicy, noCache, nil
+	}
+
+	policy, err := parseCachePolicy(override)
+
+	return policy, noCache, err
+}
+
+// serveFile answers a request for a file and reports whether it was found.
+func (app *app) serveFile(ctx neversorrow.Context, fileID string, extension string) bool {
+	policy, noCache, err := app.requestPolicy(ctx)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(err.Error(), http.StatusBadRequest))
+		return false
+	}
+
+	fileToServe := app.resolveFileID(fileID)
+
+	file, cached, failed, err := app.lookupFile(fileToServe, extension, policy, noCache)
 	if err != nil {
 		errorFromCache := fmt.Sprintf("error during lookup of file %v: %v", fileToServe, err)
 
-		ctx.Error(errors.NewWithCode(errorFromCache, http.StatusInternalServerError))
+		statusCode := http.StatusInternalServerError
+		if err == errBreakerOpen || err == errUpstreamBusy {
+			statusCode = http.StatusServiceUnavailable
+		}
 
-		return
+		ctx.Error(errors.NewWithCode(errorFromCache, statusCode))
+
+		return false
 	} else if file == nil {
 
 		ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
-		return
+		return false
 	}
 
 	log.Printf("[serveFile] file found: %v %v %v", file.file, file.fileType, file.lastModified)
 
+	app.recordAccess(file)
+
+	content := io.ReadCloser(ioutil.NopCloser(bytes.NewReader(file.content)))
+	if file == cached {
+		content, err = app.openFileInCache(file)
+		if err != nil {
+			ctx.Error(errors.NewWithCode(fmt.Sprintf("error during read of file %v: %v", fileToServe, err), http.StatusInternalServerError))
+			return false
+		} else if content == nil {
+			ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+			return false
+		}
+	}
+	defer func() { _ = content.Close() }()
+
 	resp := ctx.ResponseWriter()
 
-	if file.fileType == "png" {
-		resp.Header().Set(contentType, "image/png")
-	} else {
-		resp.Header().Set(contentType, "text/plain")
+	if failed {
+		resp.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	resp.Header().Set("Cache-Control", app.cacheControl(file, failed))
+
+	resp.Header().Set(contentType, contentTypeOf(file.fileType))
+
+	// an *os.File from the filesystem backend is sent with sendfile
+	if _, err := io.Copy(resp, content); err != nil {
+		log.Printf("[serveFile] couldn't send %v: %v", fileToServe, err)
+	}
+
+	return true
+}
+
+// lookupFile returns the entry to serve for a request, refreshing or creating
+// it as needed. cached is the entry found in the cache, if file is cached its
+// content still has to be opened. failed is set when serving an old entry
+// because refreshing it failed.
+func (app *app) lookupFile(fileToServe string, extension string, policy cachePolicy, noCache bool) (file *file, cached *file, failed bool, err error) {
+	// content of cached files is only read when it is sent
+	cached, err = app.getFileMetadataFromCache(fileToServe, extension)
+	file = cached
+
+	if err == nil && file != nil && !noCache && app.isOutdated(file) {
+		file = nil
+	}
+
+	if err == nil && file != nil && !noCache {
+		switch app.freshness(file, policy) {
+		case freshnessStale:
+			app.refreshInBackground(fileToServe, extension)
+		case freshnessExpired:
+			if changed, refreshErr := app.refreshEntry(fileToServe, extension, priorityInteractive); refreshErr != nil {
+				log.Printf("[lookupFile] couldn't refresh %v, serving cached: %v", fileToServe, refreshErr)
+				app.backOffRefresh(fileToServe, extension)
+				failed = true
+			} else if changed {
+				file = nil
+			} else {
+				file.lastModified = time.Now().UTC()
+			}
+		}
+	}
+
+	if err == nil && (file == nil || noCache) {
+		file, err = app.noImageFileInCache(fileToServe, extension, noCache, policy)
+
+		if err != nil && cached != nil {
+			log.Printf("[lookupFile] serving stale %v %v: %v", cached.file, cached.fileType, err)
+			file, err = cached, nil
+			failed = true
+		}
 	}
 
-	resp.Write(file.content)
+	return file, cached, failed, err
 }
@@ -0,0 +1,172 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+func lookupPNG(t *testing.T, app *app, fileID string, policy cachePolicy) (*file, bool) {
+	t.Helper()
+
+	found, cached, failed, err := app.lookupFile(fileID, "png", policy, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if found == nil {
+		t.Fatalf("%v not found", fileID)
+	}
+
+	if found == cached {
+		content, err := app.getFileFromCache(fileID, "png")
+		if err != nil || content == nil {
+			t.Fatalf("couldn't read cached %v: %v", fileID, err)
+		}
+		found.content = content.content
+	}
+
+	return found, failed
+}
+
+func pixelOf(t *testing.T, variant *file) uint32 {
+	t.Helper()
+
+	img, err := png.Decode(bytes.NewReader(variant.content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, g, b, _ := img.At(0, 0).RGBA()
+
+	return r>>8<<16 | g>>8<<8 | b>>8
+}
+
+func TestLookupFileCachesVariants(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	app := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+	})
+
+	first, _ := lookupPNG(t, app, "1", cachePolicyCacheFirst)
+	second, _ := lookupPNG(t, app, "1", cachePolicyCacheFirst)
+
+	if pixel := pixelOf(t, first); pixel != 0xff0000 {
+		t.Fatalf("got pixel %06x, want red", pixel)
+	}
+	if !bytes.Equal(first.content, second.content) {
+		t.Fatal("cached variant differs from the rendered one")
+	}
+	if requests, _ := upstream.counts(); requests != 1 {
+		t.Fatalf("got %v upstream requests, want 1", requests)
+	}
+
+	if missing, _, _, err := app.lookupFile("2", "png", cachePolicyCacheFirst, false); err != nil || missing != nil {
+		t.Fatalf("got %v, %v for a missing file", missing, err)
+	}
+}
+
+func TestLookupFileRevalidates(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	app := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+	})
+
+	lookupPNG(t, app, "1", cachePolicyUpstreamFirst)
+	unchanged, _ := lookupPNG(t, app, "1", cachePolicyUpstreamFirst)
+	if pixel := pixelOf(t, unchanged); pixel != 0xff0000 {
+		t.Fatalf("got pixel %06x, want red", pixel)
+	}
+	if requests, notModified := upstream.counts(); requests != 2 || notModified != 1 {
+		t.Fatalf("got %v requests and %v 304s, want 2 and 1", requests, notModified)
+	}
+
+	upstream.set("1", testTexture(0x001f001f))
+
+	changed, _ := lookupPNG(t, app, "1", cachePolicyUpstreamFirst)
+	if pixel := pixelOf(t, changed); pixel != 0x0000ff {
+		t.Fatalf("got pixel %06x, want blue", pixel)
+	}
+}
+
+func TestLookupFileServesStaleWhenUpstreamFails(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	app := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+	})
+
+	lookupPNG(t, app, "1", cachePolicyCacheFirst)
+	upstream.Close()
+
+	stale, failed := lookupPNG(t, app, "1", cachePolicyUpstreamFirst)
+	if !failed {
+		t.Fatal("serving a stale entry isn't reported as failed")
+	}
+	if pixel := pixelOf(t, stale); pixel != 0xff0000 {
+		t.Fatalf("got pixel %06x, want red", pixel)
+	}
+}
+
+// TestLookupFileReplaysCassette records a fetch and its revalidation and
+// replays both without the upstream.
+func TestLookupFileReplaysCassette(t *testing.T) {
+	cassettes := filepath.Join(t.TempDir(), "cassettes")
+
+	upstream := newTestUpstream(t)
+	upstream.set("1", testTexture(0xf800f800))
+
+	recording := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+		config.Upstream.Cassette = CassetteConfig{Mode: cassetteModeRecord, Directory: cassettes}
+	})
+	lookupPNG(t, recording, "1", cachePolicyUpstreamFirst)
+	lookupPNG(t, recording, "1", cachePolicyUpstreamFirst)
+
+	mirror := upstream.URL
+	upstream.Close()
+
+	replaying := newTestApp(t, func(config *Config) {
+		useUpstream(config, upstream)
+		config.Upstream.Mirrors = []string{mirror}
+		config.Upstream.Cassette = CassetteConfig{Mode: cassetteModeReplay, Directory: cassettes}
+	})
+
+	for i := 0; i < 2; i++ {
+		replayed, failed := lookupPNG(t, replaying, "1", cachePolicyUpstreamFirst)
+		if failed {
+			t.Fatalf("replay %v failed", i)
+		}
+		if pixel := pixelOf(t, replayed); pixel != 0xff0000 {
+			t.Fatalf("got pixel %06x, want red", pixel)
+		}
+	}
+}
+
+func TestServingCachedVariantsSkipsTheBackend(t *testing.T) {
+	fake := newFakeS3(t)
+
+	app := newTestApp(t, func(config *Config) {
+		config.Cache.Backend = storageBackendS3
+		config.Cache.S3 = fake.config
+		config.Cache.MemoryBytes = 1 << 20
+	})
+	app.sources = []textureSource{&staticSource{content: testTexture(0xf800f800)}}
+
+	lookupPNG(t, app, "1", cachePolicyCacheFirst)
+	// the raw file is read far less often than its variants
+	app.memory.remove("1", "uncompressed")
+	before := fake.requestCount()
+
+	found, _, _, err := app.lookupFile("1", "png", cachePolicyCacheFirst, false)
+	if err != nil || found == nil {
+		t.Fatalf("got %+v, %v", found, err)
+	}
+	if requests := fake.requestCount() - before; requests != 0 {
+		t.Fatalf("serving a cached variant sent %v requests to S3", requests)
+	}
+}
@@ -0,0 +1,211 @@
+package gw2imageserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type priority int
+
+const (
+	priorityInteractive priority = iota
+	priorityBackground
+
+	priorityCount
+)
+
+var errUpstreamBusy = errors.New("upstream is busy, gave up waiting for a request slot")
+
+type limiterWaiter struct {
+	ready chan struct{}
+}
+
+// upstreamLimiter combines a token bucket with a cap on concurrent requests.
+// Waiting interactive requests are always dispatched before background ones.
+type upstreamLimiter struct {
+	mutex sync.Mutex
+
+	rate  float64
+	burst float64
+
+	tokens     float64
+	lastRefill time.Time
+
+	maxConcurrent int
+	running       int
+
+	queues     [priorityCount][]*limiterWaiter
+	timerArmed bool
+}
+
+type limiterStatus struct {
+	Running       int     `json:"running"`
+	MaxConcurrent int     `json:"maxConcurrent"`
+	Tokens        float64 `json:"tokens"`
+	Rate          float64 `json:"rate"`
+
+	QueuedInteractive int `json:"queuedInteractive"`
+	QueuedBackground  int `json:"queuedBackground"`
+}
+
+func newUpstreamLimiter(rate float64, burst int, maxConcurrent int) *upstreamLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &upstreamLimiter{
+		rate:  rate,
+		burst: float64(burst),
+
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+
+		maxConcurrent: maxConcurrent,
+	}
+}
+
+// acquire blocks until a request of the given priority may start, or fails
+// with errUpstreamBusy after timeout; 0 waits forever. The returned function
+// must be called once the request is done.
+func (limiter *upstreamLimiter) acquire(prio priority, timeout time.Duration) (func(), error) {
+	waiter := &limiterWaiter{
+		ready: make(chan struct{}),
+	}
+
+	limiter.mutex.Lock()
+	limiter.queues[prio] = append(limiter.queues[prio], waiter)
+	limiter.dispatch()
+	limiter.mutex.Unlock()
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-waiter.ready:
+		case <-timer.C:
+			if !limiter.abandon(prio, waiter) {
+				return nil, errUpstreamBusy
+			}
+		}
+	}
+	<-waiter.ready
+
+	var once sync.Once
+	return func() {
+		once.Do(limiter.release)
+	}, nil
+}
+
+// abandon takes a waiter out of its queue and reports whether it was
+// dispatched meanwhile, so it has the slot anyway.
+func (limiter *upstreamLimiter) abandon(prio priority, waiter *limiterWaiter) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for i, queued := range limiter.queues[prio] {
+		if queued == waiter {
+			limiter.queues[prio] = append(limiter.queues[prio][:i:i], limiter.queues[prio][i+1:]...)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (limiter *upstreamLimiter) release() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.running--
+	limiter.dispatch()
+}
+
+func (limiter *upstreamLimiter) refill() {
+	if limiter.rate <= 0 {
+		return
+	}
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.lastRefill = now
+}
+
+// dispatch starts as many queued requests as the limits allow, highest
+// priority first. Must be called with the mutex held.
+func (limiter *upstreamLimiter) dispatch() {
+	limiter.refill()
+
+	for {
+		if limiter.maxConcurrent > 0 && limiter.running >= limiter.maxConcurrent {
+			return
+		}
+
+		prio, ok := limiter.nextQueue()
+		if !ok {
+			return
+		}
+
+		if limiter.rate > 0 {
+			if limiter.tokens < 1 {
+				limiter.armTimer()
+				return
+			}
+			limiter.tokens--
+		}
+
+		waiter := limiter.queues[prio][0]
+		limiter.queues[prio] = limiter.queues[prio][1:]
+
+		limiter.running++
+		close(waiter.ready)
+	}
+}
+
+func (limiter *upstreamLimiter) nextQueue() (priority, bool) {
+	for prio := range limiter.queues {
+		if len(limiter.queues[prio]) > 0 {
+			return priority(prio), true
+		}
+	}
+
+	return 0, false
+}
+
+func (limiter *upstreamLimiter) armTimer() {
+	if limiter.timerArmed {
+		return
+	}
+	limiter.timerArmed = true
+
+	wait := time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+
+	time.AfterFunc(wait, func() {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+
+		limiter.timerArmed = false
+		limiter.dispatch()
+	})
+}
+
+func (limiter *upstreamLimiter) status() limiterStatus {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.refill()
+
+	return limiterStatus{
+		Running:       limiter.running,
+		MaxConcurrent: limiter.maxConcurrent,
+		Tokens:        limiter.tokens,
+		Rate:          limiter.rate,
+
+		QueuedInteractive: len(limiter.queues[priorityInteractive]),
+		QueuedBackground:  len(limiter.queues[priorityBackground]),
+	}
+}
@@ -0,0 +1,34 @@
+package gw2imageserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterGivesUpWaiting(t *testing.T) {
+	limiter := newUpstreamLimiter(0, 1, 1)
+
+	release, err := limiter.acquire(priorityInteractive, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := limiter.acquire(priorityInteractive, 20*time.Millisecond); err != errUpstreamBusy {
+		t.Fatalf("got %v while the only slot is taken, want errUpstreamBusy", err)
+	}
+	if status := limiter.status(); status.QueuedInteractive != 0 || status.Running != 1 {
+		t.Fatalf("got %+v after giving up", status)
+	}
+
+	release()
+
+	release, err = limiter.acquire(priorityInteractive, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("got %v for the released slot", err)
+	}
+	release()
+
+	if status := limiter.status(); status.Running != 0 {
+		t.Fatalf("got %+v after releasing everything", status)
+	}
+}
@@ -0,0 +1,264 @@
+package gw2imageserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ptolstoi/gw2imageserver/internal/datInflater"
+)
+
+const (
+	fccPF   = "PF"
+	fccARMF = "ARMF"
+	fccMAIN = "MAIN"
+)
+
+type ManifestConfig struct {
+	// Refresh is how often the latest build number is polled, 0 disables
+	// manifest resolution and file IDs are fetched as requested.
+	Refresh time.Duration
+}
+
+type manifestEntry struct {
+	fileID uint32
+	size   uint32
+}
+
+type manifest struct {
+	build   uint32
+	entries map[uint32]manifestEntry
+}
+
+type manifestState struct {
+	mutex sync.RWMutex
+
+	manifest    *manifest
+	lastRefresh time.Time
+	lastError   string
+}
+
+type manifestStatus struct {
+	Build       uint32     `json:"build"`
+	Files       int        `json:"files"`
+	LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func (app *app) initManifest(config ManifestConfig) {
+	if config.Refresh <= 0 {
+		return
+	}
+
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+
+		ticker := time.NewTicker(config.Refresh)
+		defer ticker.Stop()
+
+		for {
+			if err := app.refreshManifest(); err != nil {
+				log.Printf("[refreshManifest] %v", err)
+
+				app.manifest.mutex.Lock()
+				app.manifest.lastError = err.Error()
+				app.manifest.mutex.Unlock()
+			}
+
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (app *app) refreshManifest() error {
+	response, err := app.upstream.fetchPath(app.upstream.config.LatestPath, priorityBackground)
+	if err != nil {
+		return err
+	}
+
+	build, err := parseLatest(string(response.body))
+	if err != nil {
+		return err
+	}
+
+	app.manifest.mutex.RLock()
+	current := app.manifest.manifest
+	app.manifest.mutex.RUnlock()
+
+	if current != nil && current.build == build {
+		app.manifest.mutex.Lock()
+		app.manifest.lastRefresh = time.Now().UTC()
+		app.manifest.lastError = ""
+		app.manifest.mutex.Unlock()
+
+		return nil
+	}
+
+	log.Printf("[refreshManifest] new build %v, downloading manifest", build)
+
+	path := strings.Replace(app.upstream.config.ManifestPath, "{build}", strconv.FormatUint(uint64(build), 10), -1)
+
+	response, err = app.upstream.fetchPath(path, priorityBackground)
+	if err != nil {
+		return err
+	}
+
+	data := response.body
+	if len(data) >= 2 && string(data[0:2]) != fccPF {
+		if data, err = datInflater.Inflate(data, 0); err != nil {
+			return fmt.Errorf("couldn't inflate manifest: %v", err)
+		}
+	}
+
+	newManifest, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	if newManifest.build == 0 {
+		newManifest.build = build
+	}
+
+	log.Printf("[refreshManifest] build=%v files=%v", newManifest.build, len(newManifest.entries))
+
+	app.manifest.mutex.Lock()
+	app.manifest.manifest = newManifest
+	app.manifest.lastRefresh = time.Now().UTC()
+	app.manifest.lastError = ""
+	app.manifest.mutex.Unlock()
+
+	return nil
+}
+
+// resolveFileID maps a base file ID to the file ID of the current build.
+// Unknown IDs, and every ID while no manifest is loaded, map to themselves.
+func (app *app) resolveFileID(fileID string) string {
+	baseID, err := strconv.ParseUint(fileID, 10, 32)
+	if err != nil {
+		return fileID
+	}
+
+	app.manifest.mutex.RLock()
+	defer app.manifest.mutex.RUnlock()
+
+	if app.manifest.manifest == nil {
+		return fileID
+	}
+
+	entry, ok := app.manifest.manifest.entries[uint32(baseID)]
+	if !ok {
+		return fileID
+	}
+
+	return strconv.FormatUint(uint64(entry.fileID), 10)
+}
+
+func (app *app) manifestStatus() manifestStatus {
+	app.manifest.mutex.RLock()
+	defer app.manifest.mutex.RUnlock()
+
+	status := manifestStatus{
+		LastError: app.manifest.lastError,
+	}
+
+	if app.manifest.manifest != nil {
+		status.Build = app.manifest.manifest.build
+		status.Files = len(app.manifest.manifest.entries)
+	}
+	if !app.manifest.lastRefresh.IsZero() {
+		lastRefresh := app.manifest.lastRefresh
+		status.LastRefresh = &lastRefresh
+	}
+
+	return status
+}
+
+// parseLatest reads the build number from a /latest response, which is a
+// whitespace separated list starting with the build number.
+func parseLatest(body string) (uint32, error) {
+	fields := strings.Fields(body)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty latest response")
+	}
+
+	build, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid build number %q: %v", fields[0], err)
+	}
+
+	return uint32(build), nil
+}
+
+// parseManifest reads an ARMF pack file:
+//
+//	PF header: "PF", flags u16, zero u16, headerSize u16, "ARMF"
+//	chunk:     fourCC, dataSize u32, version u16, headerSize u16, descriptorOffset u32
+//	MAIN:      version u32, build u32, flags u32, records (count u32, relative offset u32)
+//	record:    baseID u32, fileID u32, size u32, flags u32
+func parseManifest(data []byte) (*manifest, error) {
+	if len(data) < 12 || string(data[0:2]) != fccPF {
+		return nil, fmt.Errorf("manifest is not a pack file")
+	}
+	if string(data[8:12]) != fccARMF {
+		return nil, fmt.Errorf("unexpected pack file type: %v", string(data[8:12]))
+	}
+
+	offset := uint64(binary.LittleEndian.Uint16(data[6:8]))
+
+	for offset+16 <= uint64(len(data)) {
+		fourCC := string(data[offset : offset+4])
+		dataSize := uint64(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		headerSize := uint64(binary.LittleEndian.Uint16(data[offset+10 : offset+12]))
+
+		next := offset + 8 + dataSize
+		if next > uint64(len(data)) || headerSize < 16 || offset+headerSize > next {
+			return nil, fmt.Errorf("truncated manifest chunk %v", fourCC)
+		}
+
+		if fourCC == fccMAIN {
+			return parseManifestMain(data[offset+headerSize : next])
+		}
+
+		offset = next
+	}
+
+	return nil, fmt.Errorf("manifest has no %v chunk", fccMAIN)
+}
+
+func parseManifestMain(chunk []byte) (*manifest, error) {
+	if len(chunk) < 20 {
+		return nil, fmt.Errorf("manifest chunk too small")
+	}
+
+	count := binary.LittleEndian.Uint32(chunk[12:16])
+	start := 16 + uint64(binary.LittleEndian.Uint32(chunk[16:20]))
+	end := start + uint64(count)*16
+
+	if end > uint64(len(chunk)) {
+		return nil, fmt.Errorf("manifest records out of bounds: count=%v", count)
+	}
+
+	result := manifest{
+		build:   binary.LittleEndian.Uint32(chunk[4:8]),
+		entries: make(map[uint32]manifestEntry, count),
+	}
+
+	for position := start; position < end; position += 16 {
+		record := chunk[position : position+16]
+
+		result.entries[binary.LittleEndian.Uint32(record[0:4])] = manifestEntry{
+			fileID: binary.LittleEndian.Uint32(record[4:8]),
+			size:   binary.LittleEndian.Uint32(record[8:12]),
+		}
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,41 @@
+package gw2imageserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitsForManifestRefresh(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	latest := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requested <- struct{}{}
+		<-release
+		http.NotFound(writer, request)
+	}))
+	t.Cleanup(latest.Close)
+
+	app := newTestApp(t, func(config *Config) {
+		config.Upstream.Disabled = false
+		config.Upstream.Mirrors = []string{latest.URL}
+		config.Upstream.LatestPath = "/latest"
+	})
+	// runs before the app shuts down
+	t.Cleanup(func() { close(release) })
+	app.initManifest(ManifestConfig{Refresh: time.Hour})
+	<-requested
+
+	stopped := make(chan struct{})
+	go func() {
+		app.background.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("shutdown doesn't wait for the running manifest refresh")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,172 @@
+package gw2imageserver
+
+import (
+	"container/list"
+	"sync"
+)
+
+type memoryKey struct {
+	file     string
+	fileType string
+}
+
+// memoryCache is a size-bounded LRU of complete files in front of the
+// storage backend.
+type memoryCache struct {
+	mutex sync.Mutex
+
+	budget int
+	used   int
+
+	entries map[memoryKey]*list.Element
+	order   *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type memoryCacheStatus struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+	Budget  int `json:"budget"`
+
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+func newMemoryCache(budget int) *memoryCache {
+	return &memoryCache{
+		budget: budget,
+
+		entries: map[memoryKey]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// fits reports whether a file of the given size is worth keeping in memory,
+// bigger files are streamed from the backend instead.
+func (cache *memoryCache) fits(size int) bool {
+	return cache.budget > 0 && size <= cache.budget/8
+}
+
+// get returns a copy of the cached file, so callers may change it.
+func (cache *memoryCache) get(fileID string, fileType string) *file {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[memoryKey{fileID, fileType}]
+	if !ok {
+		cache.misses++
+		return nil
+	}
+
+	cache.hits++
+	cache.order.MoveToFront(element)
+
+	cached := *element.Value.(*file)
+
+	return &cached
+}
+
+// peek is get without counting a hit or miss or refreshing the entry.
+func (cache *memoryCache) peek(fileID string, fileType string) *file {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[memoryKey{fileID, fileType}]
+	if !ok {
+		return nil
+	}
+
+	cached := *element.Value.(*file)
+
+	return &cached
+}
+
+func (cache *memoryCache) add(added *file) {
+	if !cache.fits(len(added.content)) {
+		cache.remove(added.file, added.fileType)
+		return
+	}
+
+	stored := *added
+	stored.size = len(stored.content)
+	key := memoryKey{stored.file, stored.fileType}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.used -= len(element.Value.(*file).content)
+		element.Value = &stored
+		cache.order.MoveToFront(element)
+	} else {
+		cache.entries[key] = cache.order.PushFront(&stored)
+	}
+	cache.used += len(stored.content)
+
+	for cache.used > cache.budget {
+		oldest := cache.order.Back()
+		cache.removeElement(oldest)
+		cache.evictions++
+	}
+}
+
+// touch updates lastModified of a cached file without counting as a hit.
+func (cache *memoryCache) touch(touched *file) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[memoryKey{touched.file, touched.fileType}]; ok {
+		updated := *element.Value.(*file)
+		updated.lastModified = touched.lastModified
+		element.Value = &updated
+	}
+}
+
+func (cache *memoryCache) remove(fileID string, fileType string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[memoryKey{fileID, fileType}]; ok {
+		cache.removeElement(element)
+	}
+}
+
+// removeDerived drops everything but the raw file of fileID.
+func (cache *memoryCache) removeDerived(fileID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for key, element := range cache.entries {
+		if key.file == fileID && key.fileType != "uncompressed" {
+			cache.removeElement(element)
+		}
+	}
+}
+
+// removeElement must be called with the mutex held.
+func (cache *memoryCache) removeElement(element *list.Element) {
+	removed := element.Value.(*file)
+
+	cache.order.Remove(element)
+	delete(cache.entries, memoryKey{removed.file, removed.fileType})
+	cache.used -= len(removed.content)
+}
+
+func (cache *memoryCache) status() memoryCacheStatus {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return memoryCacheStatus{
+		Entries: len(cache.entries),
+		Bytes:   cache.used,
+		Budget:  cache.budget,
+
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+	}
+}
@@ -0,0 +1,566 @@
+package gw2imageserver
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// MigrationStatus describes one migration of cache.db.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// migrations are applied in order, each in its own transaction. Never change
+// a released migration, add a new one instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create raw and signature tables",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx, `
+				CREATE TABLE IF NOT EXISTS 
+					raw
+				(
+					file TEXT NOT NULL,
+					lastModified TEXT,
+					fileType TEXT,
+					content BLOB,
+
+					CONSTRAINT file_fileType UNIQUE (file, filetype)
+				)
+			`, `
+				CREATE INDEX IF NOT EXISTS 
+					raw_file_fileType
+				ON 
+					raw
+				(
+					file,
+					fileType
+				)
+			`, `
+				CREATE TABLE IF NOT EXISTS 
+					signature
+				(
+					signature TEXT NOT NULL PRIMARY KEY,
+					file TEXT NOT NULL,
+					firstSeen TEXT
+				)
+			`)
+		},
+	},
+	{
+		// databases from before migrations may already have these columns
+		version: 2,
+		name:    "add upstream validators and access tracking to raw",
+		up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "raw", "etag", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "raw", "upstreamModified", "TEXT"); err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "raw", "lastAccess", "INTEGER"); err != nil {
+				return err
+			}
+			return addColumnIfMissing(tx, "raw", "hits", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+	{
+		version: 3,
+		name:    "store raw.lastModified as unix seconds",
+		up:      migrateLastModifiedToUnix,
+	},
+	{
+		version: 4,
+		name:    "move content into blob by sha256",
+		up:      migrateContentToBlob,
+	},
+	{
+		version: 5,
+		name:    "add derivations of variants to raw",
+		up: func(tx *sql.Tx) error {
+			columns := [][2]string{
+				{"sourceSha256", "TEXT"},
+				{"decoderVersion", "INTEGER"},
+				{"encodeOptions", "TEXT"},
+				{"width", "INTEGER"},
+				{"height", "INTEGER"},
+			}
+
+			for _, column := range columns {
+				if err := addColumnIfMissing(tx, "raw", column[0], column[1]); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		// existing raw files become their first revision
+		version: 6,
+		name:    "keep every revision of raw files",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx, `
+				CREATE TABLE
+					revision
+				(
+					file TEXT NOT NULL,
+					revision INTEGER NOT NULL,
+					sha256 TEXT NOT NULL,
+					size INTEGER NOT NULL,
+					firstSeen INTEGER NOT NULL,
+					lastSeen INTEGER NOT NULL,
+
+					PRIMARY KEY (file, revision),
+					CONSTRAINT file_sha256 UNIQUE (file, sha256)
+				)
+			`, `
+				CREATE INDEX IF NOT EXISTS
+					revision_sha256
+				ON
+					revision
+				(
+					sha256
+				)
+			`, `
+				INSERT INTO
+					revision
+				SELECT
+					file, 1, sha256, size, lastModified, lastModified
+				FROM
+					raw
+				WHERE
+					fileType = 'uncompressed'
+			`)
+		},
+	},
+	{
+		version: 7,
+		name:    "store signature.firstSeen as unix seconds",
+		up:      migrateFirstSeenToUnix,
+	},
+}
+
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addColumnIfMissing(db sqlQueryer, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%v)", table))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_ = rows.Close()
+
+	log.Printf("[addColumnIfMissing] adding %v.%v", table, column)
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", table, column, definition))
+
+	return err
+}
+
+// migrateLastModifiedToUnix rebuilds raw, since SQLite can't change the type
+// of a column. Unparsable dates become 0, so those entries are revalidated.
+func migrateLastModifiedToUnix(tx *sql.Tx) error {
+	if err := execAll(tx, `ALTER TABLE raw ADD COLUMN lastModifiedUnix INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT rowid, lastModified FROM raw`)
+	if err != nil {
+		return err
+	}
+
+	converted := map[int64]int64{}
+	for rows.Next() {
+		var rowID int64
+		var lastModified sql.NullString
+
+		if err := rows.Scan(&rowID, &lastModified); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		if parsed, err := time.Parse(time.RFC1123Z, lastModified.String); err == nil {
+			converted[rowID] = parsed.Unix()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	_ = rows.Close()
+
+	for rowID, lastModified := range converted {
+		if _, err := tx.Exec(`UPDATE raw SET lastModifiedUnix = ? WHERE rowid = ?`, lastModified, rowID); err != nil {
+			return err
+		}
+	}
+
+	return execAll(tx, `
+		CREATE TABLE
+			raw_new
+		(
+			file TEXT NOT NULL,
+			lastModified INTEGER NOT NULL,
+			fileType TEXT,
+			content BLOB,
+			etag TEXT,
+			upstreamModified TEXT,
+			lastAccess INTEGER,
+			hits INTEGER NOT NULL DEFAULT 0,
+
+			CONSTRAINT file_fileType UNIQUE (file, filetype)
+		)
+	`, `
+		INSERT INTO
+			raw_new
+		SELECT
+			file, lastModifiedUnix, fileType, content, etag, upstreamModified, lastAccess, hits
+		FROM
+			raw
+	`, `
+		DROP TABLE raw
+	`, `
+		ALTER TABLE raw_new RENAME TO raw
+	`, `
+		CREATE INDEX IF NOT EXISTS 
+			raw_file_fileType
+		ON 
+			raw
+		(
+			file,
+			fileType
+		)
+	`)
+}
+
+// migrateFirstSeenToUnix rebuilds signature like migrateLastModifiedToUnix
+// rebuilds raw. Unparsable dates become 0.
+func migrateFirstSeenToUnix(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT signature, firstSeen FROM signature`)
+	if err != nil {
+		return err
+	}
+
+	converted := map[string]int64{}
+	for rows.Next() {
+		var signature string
+		var firstSeen sql.NullString
+
+		if err := rows.Scan(&signature, &firstSeen); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		if parsed, err := time.Parse(time.RFC1123Z, firstSeen.String); err == nil {
+			converted[signature] = parsed.Unix()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	_ = rows.Close()
+
+	err = execAll(tx, `
+		CREATE TABLE
+			signature_new
+		(
+			signature TEXT NOT NULL PRIMARY KEY,
+			file TEXT NOT NULL,
+			firstSeen INTEGER NOT NULL DEFAULT 0
+		)
+	`, `
+		INSERT INTO
+			signature_new (signature, file)
+		SELECT
+			signature, file
+		FROM
+			signature
+	`)
+	if err != nil {
+		return err
+	}
+
+	for signature, firstSeen := range converted {
+		if _, err := tx.Exec(`UPDATE signature_new SET firstSeen = ? WHERE signature = ?`, firstSeen, signature); err != nil {
+			return err
+		}
+	}
+
+	return execAll(tx, `
+		DROP TABLE signature
+	`, `
+		ALTER TABLE signature_new RENAME TO signature
+	`)
+}
+
+// migrateContentToBlob hashes every row one at a time, so the cache doesn't
+// have to fit into memory, then rebuilds raw without content.
+func migrateContentToBlob(tx *sql.Tx) error {
+	err := execAll(tx, `
+		CREATE TABLE
+			blob
+		(
+			sha256 TEXT NOT NULL PRIMARY KEY,
+			content BLOB NOT NULL
+		)
+	`, `
+		ALTER TABLE raw ADD COLUMN sha256 TEXT
+	`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT rowid FROM raw`)
+	if err != nil {
+		return err
+	}
+
+	var rowIDs []int64
+	for rows.Next() {
+		var rowID int64
+		if err := rows.Scan(&rowID); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return err
+	}
+	_ = rows.Close()
+
+	for _, rowID := range rowIDs {
+		var content []byte
+		if err := tx.QueryRow(`SELECT IFNULL(content, x'') FROM raw WHERE rowid = ?`, rowID).Scan(&content); err != nil {
+			return err
+		}
+
+		hash := contentHash(content)
+
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO blob (sha256, content) VALUES (?, ?)`, hash, content); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE raw SET sha256 = ? WHERE rowid = ?`, hash, rowID); err != nil {
+			return err
+		}
+	}
+
+	return execAll(tx, `
+		CREATE TABLE
+			raw_new
+		(
+			file TEXT NOT NULL,
+			lastModified INTEGER NOT NULL,
+			fileType TEXT,
+			sha256 TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			etag TEXT,
+			upstreamModified TEXT,
+			lastAccess INTEGER,
+			hits INTEGER NOT NULL DEFAULT 0,
+
+			CONSTRAINT file_fileType UNIQUE (file, filetype)
+		)
+	`, `
+		INSERT INTO
+			raw_new
+		SELECT
+			file, lastModified, fileType, sha256, IFNULL(length(content), 0), etag, upstreamModified, lastAccess, hits
+		FROM
+			raw
+	`, `
+		DROP TABLE raw
+	`, `
+		ALTER TABLE raw_new RENAME TO raw
+	`, `
+		CREATE INDEX IF NOT EXISTS 
+			raw_file_fileType
+		ON 
+			raw
+		(
+			file,
+			fileType
+		)
+	`, `
+		CREATE INDEX IF NOT EXISTS
+			raw_sha256
+		ON
+			raw
+		(
+			sha256
+		)
+	`)
+}
+
+func ensureSchemaVersionTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS
+			schema_version
+		(
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT,
+			appliedAt INTEGER NOT NULL
+		)
+	`)
+
+	return err
+}
+
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	if err := ensureSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, appliedAt FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0).UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		appliedAt, ok := applied[migration.version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   migration.version,
+			Name:      migration.name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+func migrate(db *sql.DB) error {
+	statuses, err := migrationStatus(db)
+	if err != nil {
+		return err
+	}
+
+	for i, status := range statuses {
+		if status.Applied {
+			continue
+		}
+
+		if err := applyMigration(db, migrations[i]); err != nil {
+			return fmt.Errorf("migration %v (%v) failed: %v", status.Version, status.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, migration migration) error {
+	log.Printf("[migrate] applying %v: %v", migration.version, migration.name)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := migration.up(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO
+			schema_version
+				(
+					version, name, appliedAt
+				)
+		VALUES
+				(?, ?, ?)
+	`, migration.version, migration.name, time.Now().Unix())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Migrations lists all migrations of cache.db and whether they are applied.
+func Migrations(config Config) ([]MigrationStatus, error) {
+	db, err := openSQLiteWriter(config.Cache.SQLite)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = db.Close() }()
+
+	return migrationStatus(db)
+}
+
+// Migrate applies all pending migrations of cache.db, as NewApp does.
+func Migrate(config Config) error {
+	db, err := openSQLiteWriter(config.Cache.SQLite)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	return migrate(db)
+}
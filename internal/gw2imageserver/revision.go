@@ -0,0 +1,317 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ptolstoi/neversorrow"
+	"github.com/ptolstoi/neversorrow/errors"
+)
+
+// revisionCacheControl is sent with pinned revisions, which never change.
+const revisionCacheControl = "public, max-age=31536000, immutable"
+
+// revision is one distinct content of a raw file. Revisions are numbered
+// from 1 in the order they were first seen.
+type revision struct {
+	number    int
+	hash      string
+	size      int
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// storageHistory is implemented by backends that keep the revisions of raw
+// files, including their content, after the raw file has been replaced.
+type storageHistory interface {
+	// recordRevision notes that the content of a raw file was seen at seen.
+	// The content has to be saved already.
+	recordRevision(file *file, seen time.Time) error
+	revisions(fileID string) ([]revision, error)
+	// getRevision returns nil if there is no such revision.
+	getRevision(fileID string, number int) (*file, error)
+}
+
+// revisionIndex is the history of one raw file as the filesystem and S3
+// backends keep it, in JSON.
+type revisionIndex struct {
+	File      string               `json:"file"`
+	Revisions []revisionIndexEntry `json:"revisions"`
+}
+
+type revisionIndexEntry struct {
+	Revision  int       `json:"revision"`
+	SHA256    string    `json:"sha256"`
+	Size      int       `json:"size"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// record adds the content of file seen at seen, and reports whether it is a
+// new revision.
+func (index *revisionIndex) record(file *file, seen time.Time) bool {
+	for i := range index.Revisions {
+		entry := &index.Revisions[i]
+		if entry.SHA256 != file.hash {
+			continue
+		}
+
+		if seen.Before(entry.FirstSeen) {
+			entry.FirstSeen = seen
+		}
+		if seen.After(entry.LastSeen) {
+			entry.LastSeen = seen
+		}
+		return false
+	}
+
+	size := file.size
+	if file.content != nil {
+		size = len(file.content)
+	}
+
+	index.Revisions = append(index.Revisions, revisionIndexEntry{
+		Revision:  len(index.Revisions) + 1,
+		SHA256:    file.hash,
+		Size:      size,
+		FirstSeen: seen,
+		LastSeen:  seen,
+	})
+
+	return true
+}
+
+func (index *revisionIndex) list() []revision {
+	var revisions []revision
+	for _, entry := range index.Revisions {
+		revisions = append(revisions, revision{
+			number:    entry.Revision,
+			hash:      entry.SHA256,
+			size:      entry.Size,
+			firstSeen: entry.FirstSeen,
+			lastSeen:  entry.LastSeen,
+		})
+	}
+
+	return revisions
+}
+
+type revisionView struct {
+	Revision  int       `json:"revision"`
+	Hash      string    `json:"sha256"`
+	Size      int       `json:"size"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Current   bool      `json:"current"`
+}
+
+type revisionList struct {
+	File      string         `json:"file"`
+	Revisions []revisionView `json:"revisions"`
+}
+
+func (app *app) initRevisionHTTP() {
+	app.AddRoute("GET", "/v1/revisions/:file", app.serveRevisions)
+}
+
+// recordRevision adds a raw file that upstream sent or confirmed at seen to
+// its history. Failing to do so doesn't fail the request that fetched it.
+func (app *app) recordRevision(file *file, seen time.Time) {
+	history, ok := app.storage.(storageHistory)
+	if !ok || file.fileType != "uncompressed" || file.hash == "" {
+		return
+	}
+
+	if err := history.recordRevision(file, seen); err != nil {
+		log.Printf("[recordRevision] %v %v: %v", file.file, file.hash, err)
+	}
+}
+
+// revisionFileID is the file ID variants of a revision are cached under.
+// They never change, so nothing has to invalidate them.
+func revisionFileID(fileID string, number int) string {
+	return fmt.Sprintf("%v@%v", fileID, number)
+}
+
+// deletePinnedFilesFromCache removes the variants of every revision of
+// fileID, which purging or refetching the file drops as well.
+func (app *app) deletePinnedFilesFromCache(fileID string) error {
+	history, ok := app.storage.(storageHistory)
+	if !ok {
+		return nil
+	}
+
+	revisions, err := history.revisions(fileID)
+	if err != nil {
+		return err
+	}
+
+	for _, pinned := range revisions {
+		if err := app.deleteDerivedFilesFromCache(revisionFileID(fileID, pinned.number)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitRevision splits "<file>@<revision>" as in /v1/image/:file@:rev.
+func splitRevision(param string) (string, int, bool, error) {
+	parts := strings.SplitN(param, "@", 2)
+	if len(parts) < 2 {
+		return param, 0, false, nil
+	}
+
+	number, err := strconv.Atoi(parts[1])
+	if err != nil || number < 1 {
+		return "", 0, true, fmt.Errorf("invalid revision %q", parts[1])
+	}
+
+	return parts[0], number, true, nil
+}
+
+func (app *app) history(ctx neversorrow.Context) (storageHistory, bool) {
+	history, ok := app.storage.(storageHistory)
+	if !ok {
+		ctx.Error(errors.NewWithCode("the cache backend doesn't keep revisions", http.StatusNotImplemented))
+	}
+
+	return history, ok
+}
+
+// serveRevisions lists the revisions of a file. With ?at=<RFC 3339 time>
+// only the revision that was live at that time is listed.
+func (app *app) serveRevisions(ctx neversorrow.Context) {
+	history, ok := app.history(ctx)
+	if !ok {
+		return
+	}
+
+	fileID := app.resolveFileID(ctx.Params()["file"])
+
+	revisions, err := history.revisions(fileID)
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("error during lookup of revisions of %v: %v", fileID, err), http.StatusInternalServerError))
+		return
+	}
+
+	current, err := app.getFileMetadataFromCache(fileID, "uncompressed")
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("error during lookup of file %v: %v", fileID, err), http.StatusInternalServerError))
+		return
+	}
+
+	if at := ctx.Request().URL.Query().Get("at"); at != "" {
+		atTime, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			ctx.Error(errors.NewWithCode(fmt.Sprintf("invalid at: %v", err), http.StatusBadRequest))
+			return
+		}
+
+		revisions = revisionAt(revisions, atTime)
+	}
+
+	list := revisionList{
+		File:      fileID,
+		Revisions: []revisionView{},
+	}
+	for _, revision := range revisions {
+		list.Revisions = append(list.Revisions, revisionView{
+			Revision:  revision.number,
+			Hash:      revision.hash,
+			Size:      revision.size,
+			FirstSeen: revision.firstSeen.UTC(),
+			LastSeen:  revision.lastSeen.UTC(),
+			Current:   current != nil && current.hash == revision.hash,
+		})
+	}
+
+	writeJSON(ctx, list)
+}
+
+// revisionAt returns the revision first seen last before at, if any.
+func revisionAt(revisions []revision, at time.Time) []revision {
+	var live []revision
+
+	for _, candidate := range revisions {
+		if candidate.firstSeen.After(at) {
+			continue
+		}
+		if len(live) == 0 || candidate.firstSeen.After(live[0].firstSeen) {
+			live = []revision{candidate}
+		}
+	}
+
+	return live
+}
+
+// serveRevision serves a variant of one revision of a file, building it from
+// the revision's raw content on first request.
+func (app *app) serveRevision(ctx neversorrow.Context, fileID string, number int, extension string) {
+	history, ok := app.history(ctx)
+	if !ok {
+		return
+	}
+
+	fileToServe := app.resolveFileID(fileID)
+	pinnedID := revisionFileID(fileToServe, number)
+
+	file, err := app.inflight.do(pinnedID, extension, func() (*file, error) {
+		if extension == "uncompressed" {
+			return history.getRevision(fileToServe, number)
+		}
+
+		cached, err := app.getFileMetadataFromCache(pinnedID, extension)
+		if err != nil || (cached != nil && !app.isOutdated(cached)) {
+			return cached, err
+		}
+
+		raw, err := history.getRevision(fileToServe, number)
+		if err != nil || raw == nil {
+			return nil, err
+		}
+
+		return app.createVariant(pinnedID, extension, raw)
+	})
+
+	if err != nil {
+		ctx.Error(errors.NewWithCode(fmt.Sprintf("error during lookup of file %v: %v", pinnedID, err), http.StatusInternalServerError))
+		return
+	} else if file == nil {
+		ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+		return
+	}
+
+	log.Printf("[serveRevision] file found: %v %v %v", file.file, file.fileType, file.lastModified)
+
+	app.accesses.record(file.file, file.fileType)
+
+	content := io.ReadCloser(ioutil.NopCloser(bytes.NewReader(file.content)))
+	if file.content == nil {
+		content, err = app.openFileInCache(file)
+		if err != nil {
+			ctx.Error(errors.NewWithCode(fmt.Sprintf("error during read of file %v: %v", pinnedID, err), http.StatusInternalServerError))
+			return
+		} else if content == nil {
+			ctx.Error(errors.NewWithCode("file not found", http.StatusNotFound))
+			return
+		}
+	}
+	defer func() { _ = content.Close() }()
+
+	resp := ctx.ResponseWriter()
+	resp.Header().Set("Cache-Control", revisionCacheControl)
+
+	resp.Header().Set(contentType, contentTypeOf(file.fileType))
+
+	if _, err := io.Copy(resp, content); err != nil {
+		log.Printf("[serveRevision] couldn't send %v: %v", pinnedID, err)
+	}
+}
@@ -0,0 +1,169 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRevisionsKeepEveryContent(t *testing.T) {
+	fake := newFakeS3(t)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	colors := map[string]uint32{"red": 0xf800f800, "blue": 0x001f001f, "green": 0x07e007e0}
+
+	for _, backend := range []string{storageBackendSQLite, storageBackendFilesystem, storageBackendS3} {
+		t.Run(backend, func(t *testing.T) {
+			app := newTestApp(t, func(config *Config) {
+				config.Cache.Backend = backend
+				config.Cache.S3 = fake.config
+				config.Cache.S3.Prefix = backend + "/"
+			})
+			history := app.storage.(storageHistory)
+
+			names := map[string]string{}
+			for name, color := range colors {
+				names[contentHash(testTexture(color))] = name
+			}
+			fetch := func(name string, hour int) {
+				raw := testFile("1", "uncompressed", testTexture(colors[name]))
+				raw.lastModified = base.Add(time.Duration(hour) * time.Hour)
+				if err := app.saveFileToCache(raw); err != nil {
+					t.Fatal(err)
+				}
+				app.recordRevision(raw, raw.lastModified)
+			}
+
+			fetch("red", 0)
+			if revisions, err := history.revisions("1"); err != nil || len(revisions) != 1 {
+				t.Fatalf("got revisions %+v, %v of an unchanged file", revisions, err)
+			}
+
+			fetch("red", 1)
+			fetch("blue", 2)
+			fetch("red", 3)
+			fetch("green", 4)
+
+			revisions, err := history.revisions("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, revision := range revisions {
+				got = append(got, fmt.Sprintf("%v %v %v-%v", revision.number, names[revision.hash],
+					revision.firstSeen.Sub(base).Hours(), revision.lastSeen.Sub(base).Hours()))
+			}
+			if want := []string{"1 red 0-3", "2 blue 2-2", "3 green 4-4"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got revisions %v, want %v", got, want)
+			}
+
+			first, err := history.getRevision("1", 1)
+			if err != nil || first == nil || !bytes.Equal(first.content, testTexture(colors["red"])) {
+				t.Fatalf("got revision 1 %+v, %v", first, err)
+			}
+			if missing, err := history.getRevision("1", 4); err != nil || missing != nil {
+				t.Fatalf("got revision 4 %+v, %v", missing, err)
+			}
+		})
+	}
+}
+
+func TestRevisionsFollowUpstream(t *testing.T) {
+	source := &staticSource{content: testTexture(0xf800f800)}
+
+	app := newTestApp(t, nil)
+	app.sources = []textureSource{source}
+	history := app.storage.(storageHistory)
+
+	lastSeen := func(want int) time.Time {
+		t.Helper()
+
+		revisions, err := history.revisions("1")
+		if err != nil || len(revisions) != want {
+			t.Fatalf("got revisions %+v, %v, want %v", revisions, err, want)
+		}
+
+		return revisions[want-1].lastSeen
+	}
+
+	if _, err := app.getUncompressedFile("1", true, cachePolicyCacheFirst); err != nil {
+		t.Fatal(err)
+	}
+	fetched := lastSeen(1)
+
+	// revisions are kept in seconds
+	time.Sleep(1100 * time.Millisecond)
+
+	// keeping the file without any source having it isn't a sighting
+	app.sources = nil
+	if _, err := app.refreshEntry("1", "uncompressed", priorityBackground); err != nil {
+		t.Fatal(err)
+	}
+	if seen := lastSeen(1); !seen.Equal(fetched) {
+		t.Fatalf("keeping the file moved its last sighting from %v to %v", fetched, seen)
+	}
+
+	app.sources = []textureSource{source}
+	if _, err := app.refreshEntry("1", "uncompressed", priorityBackground); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed := lastSeen(1); !confirmed.After(fetched) {
+		t.Fatalf("upstream confirmed the file at %v, but it was last seen at %v", confirmed, fetched)
+	}
+
+	source.content = testTexture(0x001f001f)
+	if _, err := app.refreshEntry("1", "uncompressed", priorityBackground); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen(2)
+}
+
+func TestRevisionAt(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	revisions := []revision{
+		{number: 1, firstSeen: base},
+		{number: 2, firstSeen: base.Add(2 * time.Hour)},
+		{number: 3, firstSeen: base.Add(4 * time.Hour)},
+	}
+
+	for _, test := range []struct {
+		hours float64
+		want  int
+	}{
+		{-1, 0}, {0, 1}, {1, 1}, {2, 2}, {3.5, 2}, {24, 3},
+	} {
+		live := revisionAt(revisions, base.Add(time.Duration(test.hours*float64(time.Hour))))
+
+		got := 0
+		if len(live) == 1 {
+			got = live[0].number
+		} else if len(live) > 1 {
+			t.Fatalf("at %vh: got %v revisions", test.hours, len(live))
+		}
+		if got != test.want {
+			t.Errorf("at %vh: got revision %v, want %v", test.hours, got, test.want)
+		}
+	}
+}
+
+func TestSplitRevision(t *testing.T) {
+	for _, test := range []struct {
+		param    string
+		fileID   string
+		number   int
+		revision bool
+		fails    bool
+	}{
+		{"1234", "1234", 0, false, false},
+		{"1234@2", "1234", 2, true, false},
+		{"1234@0", "", 0, true, true},
+		{"1234@latest", "", 0, true, true},
+		{"1234@", "", 0, true, true},
+	} {
+		fileID, number, revision, err := splitRevision(test.param)
+		if fileID != test.fileID || number != test.number || revision != test.revision || (err != nil) != test.fails {
+			t.Errorf("%q: got %q, %v, %v, %v", test.param, fileID, number, revision, err)
+		}
+	}
+}
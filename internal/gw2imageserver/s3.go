@@ -0,0 +1,780 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the S3-compatible service, for example
+	// https://s3.eu-central-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+
+	AccessKey string
+	SecretKey string
+
+	// PathStyle addresses the bucket as endpoint/bucket instead of
+	// bucket.endpoint, which most self-hosted servers need.
+	PathStyle bool
+
+	Timeout time.Duration
+}
+
+// s3Storage stores every file as the object <prefix><file>/<fileType>, with
+// its metadata in x-amz-meta-* headers so a HEAD is enough to look it up.
+// Revisions of raw files are kept below <prefix>.revisions/.
+// Content isn't deduplicated, that would cost a second request per lookup.
+type s3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+type s3StatusError struct {
+	method     string
+	key        string
+	statusCode int
+	body       string
+}
+
+func (err *s3StatusError) Error() string {
+	return fmt.Sprintf("s3 %v %v: %v %v", err.method, err.key, err.statusCode, err.body)
+}
+
+func isS3Status(err error, statusCode int) bool {
+	statusErr, ok := err.(*s3StatusError)
+	return ok && statusErr.statusCode == statusCode
+}
+
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// s3RevisionAttempts bounds the retries of a conditional index update.
+const s3RevisionAttempts = 5
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// IsAWSEndpoint reports whether endpoint is Amazon's S3, which addresses
+// buckets as subdomains, unlike most self-hosted servers.
+func IsAWSEndpoint(endpoint string) bool {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+
+	return host == "amazonaws.com" || strings.HasSuffix(host, ".amazonaws.com")
+}
+
+func newS3Storage(config S3Config) (*s3Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no s3 bucket configured")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %v: %v", config.Endpoint, err)
+	} else if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %v", config.Endpoint)
+	}
+
+	log.Printf("[s3Storage] endpoint=%v bucket=%v prefix=%v", config.Endpoint, config.Bucket, config.Prefix)
+
+	return &s3Storage{
+		config:   config,
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: config.Timeout,
+		},
+	}, nil
+}
+
+func (storage *s3Storage) key(fileID string, fileType string) (string, error) {
+	fileName, err := pathName(fileID)
+	if err != nil {
+		return "", err
+	}
+	typeName, err := pathName(fileType)
+	if err != nil {
+		return "", err
+	}
+
+	return storage.config.Prefix + fileName + "/" + typeName, nil
+}
+
+// s3Escape is the URI encoding of SigV4, which differs from net/url's.
+func s3Escape(value string, keepSlash bool) string {
+	var escaped strings.Builder
+
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && keepSlash) {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+
+	return escaped.String()
+}
+
+func (storage *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	location := *storage.endpoint
+
+	path := "/" + key
+	if storage.config.PathStyle {
+		path = "/" + storage.config.Bucket + path
+	} else {
+		location.Host = storage.config.Bucket + "." + location.Host
+	}
+
+	basePath := strings.TrimSuffix(storage.endpoint.Path, "/")
+	location.Path = basePath + path
+	location.RawPath = s3Escape(basePath, true) + s3Escape(path, true)
+	location.RawQuery = ""
+	if query != nil {
+		location.RawQuery = s3CanonicalQuery(query)
+	}
+
+	return &location
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 to the request.
+func (storage *s3Storage) sign(request *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host": request.URL.Host,
+	}
+	for name, values := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "if-match" || name == "if-none-match" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + storage.config.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+storage.config.SecretKey), date)
+	key = hmacSHA256(key, storage.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		storage.config.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
+
+// do sends a signed request. Unless the status is 2xx, the body is closed and
+// an *s3StatusError returned.
+func (storage *s3Storage) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, "", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.URL = storage.objectURL(key, query)
+	request.Host = request.URL.Host
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(hash[:])
+	}
+	storage.sign(request, payloadHash, time.Now())
+
+	response, err := storage.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		_ = response.Body.Close()
+
+		return nil, &s3StatusError{
+			method:     method,
+			key:        key,
+			statusCode: response.StatusCode,
+			body:       strings.TrimSpace(string(message)),
+		}
+	}
+
+	return response, nil
+}
+
+func s3MetadataHeader(file *file, hash string) http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("X-Amz-Meta-Lastmodified", file.lastModified.UTC().Format(time.RFC3339Nano))
+	header.Set("X-Amz-Meta-Sha256", hash)
+	if file.etag != "" {
+		header.Set("X-Amz-Meta-Etag", url.QueryEscape(file.etag))
+	}
+	if file.upstreamModified != "" {
+		header.Set("X-Amz-Meta-Upstreammodified", url.QueryEscape(file.upstreamModified))
+	}
+	if file.derivation.SourceSHA256 != "" {
+		header.Set("X-Amz-Meta-Sourcesha256", file.derivation.SourceSHA256)
+		header.Set("X-Amz-Meta-Decoderversion", strconv.Itoa(file.derivation.DecoderVersion))
+		header.Set("X-Amz-Meta-Encodeoptions", url.QueryEscape(file.derivation.EncodeOptions))
+		header.Set("X-Amz-Meta-Width", strconv.Itoa(file.derivation.Width))
+		header.Set("X-Amz-Meta-Height", strconv.Itoa(file.derivation.Height))
+	}
+
+	return header
+}
+
+func s3MetadataFile(fileID string, fileType string, header http.Header) (*file, error) {
+	lastModified, err := time.Parse(time.RFC3339Nano, header.Get("X-Amz-Meta-Lastmodified"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata of %v %v: %v", fileID, fileType, err)
+	}
+
+	etag, _ := url.QueryUnescape(header.Get("X-Amz-Meta-Etag"))
+	hash := header.Get("X-Amz-Meta-Sha256")
+	upstreamModified, _ := url.QueryUnescape(header.Get("X-Amz-Meta-Upstreammodified"))
+
+	// metadata can't be trusted more than content, a broken derivation just
+	// gets the variant built again
+	options, _ := url.QueryUnescape(header.Get("X-Amz-Meta-Encodeoptions"))
+	version, _ := strconv.Atoi(header.Get("X-Amz-Meta-Decoderversion"))
+	width, _ := strconv.Atoi(header.Get("X-Amz-Meta-Width"))
+	height, _ := strconv.Atoi(header.Get("X-Amz-Meta-Height"))
+
+	return &file{
+		file:         fileID,
+		fileType:     fileType,
+		lastModified: lastModified,
+		hash:         hash,
+
+		etag:             etag,
+		upstreamModified: upstreamModified,
+
+		derivation: derivation{
+			SourceSHA256:   header.Get("X-Amz-Meta-Sourcesha256"),
+			DecoderVersion: version,
+			EncodeOptions:  options,
+			Width:          width,
+			Height:         height,
+		},
+	}, nil
+}
+
+// head returns the metadata and the S3 ETag of an object, or nil.
+func (storage *s3Storage) head(fileID string, fileType string) (*file, http.Header, error) {
+	key, err := storage.key(fileID, fileType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := storage.do("HEAD", key, nil, nil, nil)
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	_ = response.Body.Close()
+
+	file, err := s3MetadataFile(fileID, fileType, response.Header)
+	if file != nil {
+		file.size = int(response.ContentLength)
+	}
+
+	return file, response.Header, err
+}
+
+func (storage *s3Storage) getMetadata(fileID string, fileType string) (*file, error) {
+	file, _, err := storage.head(fileID, fileType)
+	return file, err
+}
+
+func (storage *s3Storage) open(fileID string, fileType string) (io.ReadCloser, error) {
+	key, err := storage.key(fileID, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := storage.do("GET", key, nil, nil, nil)
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (storage *s3Storage) get(fileID string, fileType string) (*file, error) {
+	key, err := storage.key(fileID, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := storage.do("GET", key, nil, nil, nil)
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	file, err := s3MetadataFile(fileID, fileType, response.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	file.content, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	file.size = len(file.content)
+
+	return file, nil
+}
+
+// save only creates objects that don't exist yet. Another replica having
+// written the same content already counts as success; different content is
+// replaced, but only if nobody replaced it in the meantime.
+func (storage *s3Storage) save(file *file) error {
+	key, err := storage.key(file.file, file.fileType)
+	if err != nil {
+		return err
+	}
+
+	header := s3MetadataHeader(file, file.hash)
+
+	header.Set("If-None-Match", "*")
+	response, err := storage.do("PUT", key, nil, header, file.content)
+	if err == nil {
+		_ = response.Body.Close()
+		return nil
+	} else if !isS3Status(err, http.StatusPreconditionFailed) {
+		return err
+	}
+
+	_, existing, err := storage.head(file.file, file.fileType)
+	if err != nil {
+		return err
+	} else if existing == nil {
+		return fmt.Errorf("s3 object %v vanished during write", key)
+	}
+
+	if existing.Get("X-Amz-Meta-Sha256") == header.Get("X-Amz-Meta-Sha256") {
+		log.Printf("[s3Storage] %v already written", key)
+		return nil
+	}
+
+	header.Del("If-None-Match")
+	header.Set("If-Match", existing.Get("ETag"))
+	response, err = storage.do("PUT", key, nil, header, file.content)
+	if isS3Status(err, http.StatusPreconditionFailed) {
+		log.Printf("[s3Storage] %v was replaced concurrently", key)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	return nil
+}
+
+// touch rewrites the metadata by copying the object onto itself.
+func (storage *s3Storage) touch(file *file) error {
+	key, err := storage.key(file.file, file.fileType)
+	if err != nil {
+		return err
+	}
+
+	_, existing, err := storage.head(file.file, file.fileType)
+	if err != nil || existing == nil {
+		return err
+	}
+
+	// REPLACE drops all metadata, keep what touch doesn't change
+	header := s3MetadataHeader(file, existing.Get("X-Amz-Meta-Sha256"))
+	for name, values := range existing {
+		if strings.HasPrefix(name, "X-Amz-Meta-") && header.Get(name) == "" {
+			header[name] = values
+		}
+	}
+	header.Set("X-Amz-Copy-Source", "/"+storage.config.Bucket+"/"+s3Escape(key, true))
+	header.Set("X-Amz-Copy-Source-If-Match", existing.Get("ETag"))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	response, err := storage.do("PUT", key, nil, header, nil)
+	if isS3Status(err, http.StatusPreconditionFailed) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	return nil
+}
+
+func (storage *s3Storage) list(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+
+	for {
+		response, err := storage.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := s3ListResult{}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 listing: %v", err)
+		}
+
+		objects = append(objects, result.Contents...)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// entries lists the bucket. S3 doesn't track accesses, so hits and
+// lastAccess stay empty.
+func (storage *s3Storage) entries() ([]storageEntry, error) {
+	objects, err := storage.list(storage.config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]storageEntry, 0, len(objects))
+	for _, object := range objects {
+		// pathName escapes slashes, anything else, like revisions, isn't an entry
+		parts := strings.Split(strings.TrimPrefix(object.Key, storage.config.Prefix), "/")
+		if len(parts) != 2 {
+			continue
+		}
+
+		fileID, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			continue
+		}
+		fileType, err := url.QueryUnescape(parts[1])
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, storageEntry{
+			file:     fileID,
+			fileType: fileType,
+			size:     object.Size,
+		})
+	}
+
+	return entries, nil
+}
+
+func (storage *s3Storage) delete(fileID string, fileType string) error {
+	key, err := storage.key(fileID, fileType)
+	if err != nil {
+		return err
+	}
+
+	response, err := storage.do("DELETE", key, nil, nil, nil)
+	if isS3Status(err, http.StatusNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	return nil
+}
+
+func (storage *s3Storage) deleteDerived(fileID string) error {
+	rawKey, err := storage.key(fileID, "uncompressed")
+	if err != nil {
+		return err
+	}
+
+	objects, err := storage.list(rawKey[:strings.LastIndex(rawKey, "/")+1])
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		key := object.Key
+		if key == rawKey {
+			continue
+		}
+
+		response, err := storage.do("DELETE", key, nil, nil, nil)
+		if isS3Status(err, http.StatusNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+	}
+
+	return nil
+}
+
+// revisionKey is the key of an object in the history of fileID, which is
+// kept below <prefix>.revisions/<file>/: index.json lists the revisions and
+// every content is stored under its hash. File names never start with a dot,
+// so these keys can't clash with entries.
+func (storage *s3Storage) revisionKey(fileID string, name string) (string, error) {
+	fileName, err := pathName(fileID)
+	if err != nil {
+		return "", err
+	}
+
+	return storage.config.Prefix + ".revisions/" + fileName + "/" + name, nil
+}
+
+// readRevisions returns the history of fileID and the S3 ETag it has to be
+// replaced with, or nil.
+func (storage *s3Storage) readRevisions(fileID string) (*revisionIndex, string, error) {
+	key, err := storage.revisionKey(fileID, "index.json")
+	if err != nil {
+		return nil, "", err
+	}
+
+	response, err := storage.do("GET", key, nil, nil, nil)
+	if isS3Status(err, http.StatusNotFound) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	revisions := revisionIndex{}
+	if err := json.NewDecoder(response.Body).Decode(&revisions); err != nil {
+		return nil, "", fmt.Errorf("corrupt revisions %v: %v", key, err)
+	}
+
+	return &revisions, response.Header.Get("ETag"), nil
+}
+
+// saveRevisionContent copies the content of a new revision into the history.
+// Without content, the raw file has to still have it.
+func (storage *s3Storage) saveRevisionContent(file *file) error {
+	content := file.content
+	if content == nil {
+		raw, err := storage.get(file.file, "uncompressed")
+		if err != nil {
+			return err
+		} else if raw == nil || contentHash(raw.content) != file.hash {
+			return fmt.Errorf("content %v of %v isn't stored anymore", file.hash, file.file)
+		}
+		content = raw.content
+	}
+
+	key, err := storage.revisionKey(file.file, file.hash)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("If-None-Match", "*")
+
+	response, err := storage.do("PUT", key, nil, header, content)
+	if isS3Status(err, http.StatusPreconditionFailed) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	return nil
+}
+
+// recordRevision updates the index conditionally, replicas recording the
+// same file at once retry with the index the other one wrote.
+func (storage *s3Storage) recordRevision(file *file, seen time.Time) error {
+	key, err := storage.revisionKey(file.file, "index.json")
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < s3RevisionAttempts; attempt++ {
+		revisions, etag, err := storage.readRevisions(file.file)
+		if err != nil {
+			return err
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+		if revisions == nil {
+			revisions = &revisionIndex{File: file.file}
+			header.Set("If-None-Match", "*")
+		} else {
+			header.Set("If-Match", etag)
+		}
+
+		if revisions.record(file, seen) {
+			if err := storage.saveRevisionContent(file); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(revisions)
+		if err != nil {
+			return err
+		}
+
+		response, err := storage.do("PUT", key, nil, header, data)
+		if isS3Status(err, http.StatusPreconditionFailed) {
+			log.Printf("[s3Storage] %v was replaced concurrently, retrying", key)
+			continue
+		} else if err != nil {
+			return err
+		}
+		_ = response.Body.Close()
+
+		return nil
+	}
+
+	return fmt.Errorf("couldn't update %v, it keeps being replaced", key)
+}
+
+func (storage *s3Storage) revisions(fileID string) ([]revision, error) {
+	revisions, _, err := storage.readRevisions(fileID)
+	if err != nil || revisions == nil {
+		return nil, err
+	}
+
+	return revisions.list(), nil
+}
+
+func (storage *s3Storage) getRevision(fileID string, number int) (*file, error) {
+	revisions, err := storage.revisions(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revision := range revisions {
+		if revision.number != number {
+			continue
+		}
+
+		key, err := storage.revisionKey(fileID, revision.hash)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := storage.do("GET", key, nil, nil, nil)
+		if isS3Status(err, http.StatusNotFound) {
+			log.Printf("[s3Storage] content of revision %v of %v is missing", number, fileID)
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defer func() { _ = response.Body.Close() }()
+
+		content, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return &file{
+			file:         fileID,
+			fileType:     "uncompressed",
+			lastModified: revision.lastSeen,
+			content:      content,
+			size:         revision.size,
+			hash:         revision.hash,
+		}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,129 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"time"
+)
+
+var errHashMismatch = errors.New("content doesn't match its hash")
+
+type scrubResult struct {
+	checked   int
+	corrupt   int
+	outdated  int
+	rederived int
+}
+
+func (app *app) initScrubber(config CacheConfig) {
+	if config.ScrubInterval <= 0 {
+		return
+	}
+	if _, ok := app.storage.(storageEvictor); !ok {
+		log.Printf("[initScrubber] the %v backend can't list its entries, not scrubbing", config.Backend)
+		return
+	}
+
+	app.background.Add(1)
+	go func() {
+		defer app.background.Done()
+
+		ticker := time.NewTicker(config.ScrubInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+
+			result, err := app.scrub()
+			if err != nil {
+				log.Printf("[scrub] %v", err)
+			}
+			log.Printf("[scrub] checked=%v corrupt=%v outdated=%v rederived=%v", result.checked, result.corrupt, result.outdated, result.rederived)
+		}
+	}()
+}
+
+// scrub reads every entry and checks its hash. Raw files also have to be
+// textures; broken ones are dropped and fetched again on demand. Broken and
+// outdated PNGs are rendered again from the raw file, without asking upstream.
+func (app *app) scrub() (scrubResult, error) {
+	result := scrubResult{}
+
+	entries, err := app.storage.(storageEvictor).entries()
+	if err != nil {
+		return result, err
+	}
+
+	for _, entry := range entries {
+		select {
+		case <-app.done:
+			return result, nil
+		default:
+		}
+
+		stored, err := app.storage.get(entry.file, entry.fileType)
+		if err != nil {
+			log.Printf("[scrub] couldn't read %v %v: %v", entry.file, entry.fileType, err)
+			continue
+		} else if stored == nil {
+			continue
+		}
+		result.checked++
+
+		if err := checkStoredFile(stored); err != nil {
+			log.Printf("[scrub] %v %v is broken: %v", entry.file, entry.fileType, err)
+			result.corrupt++
+
+			if err := app.deleteFileFromCache(stored.file, stored.fileType); err != nil {
+				return result, err
+			}
+
+			if stored.fileType == "uncompressed" {
+				if err := app.deleteDerivedFilesFromCache(stored.file); err != nil {
+					return result, err
+				}
+				continue
+			}
+		} else if app.isOutdated(stored) || app.hasOtherSource(stored) {
+			result.outdated++
+		} else {
+			continue
+		}
+
+		rederived, err := app.noImageFileInCache(stored.file, stored.fileType, false, cachePolicyCacheOnly)
+		if err != nil {
+			log.Printf("[scrub] couldn't render %v %v again: %v", stored.file, stored.fileType, err)
+			continue
+		} else if rederived != nil {
+			result.rederived++
+		}
+	}
+
+	return result, nil
+}
+
+func checkStoredFile(stored *file) error {
+	if !verifyHash(stored) {
+		return errHashMismatch
+	}
+
+	switch stored.fileType {
+	case "uncompressed":
+		return checkHeader(stored.content)
+	case "png":
+		_, err := png.DecodeConfig(bytes.NewReader(stored.content))
+		return err
+	case "jpg":
+		_, err := jpeg.DecodeConfig(bytes.NewReader(stored.content))
+		return err
+	}
+
+	return nil
+}
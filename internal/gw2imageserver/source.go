@@ -0,0 +1,92 @@
+package gw2imageserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ptolstoi/gw2imageserver/internal/datFile"
+)
+
+type ArchiveConfig struct {
+	// Path of a local Gw2.dat, textures are read from it before asking upstream.
+	Path string
+}
+
+type fetchedTexture struct {
+	content []byte
+
+	etag             string
+	upstreamModified string
+	notModified      bool
+}
+
+type textureSource interface {
+	name() string
+
+	// fetch returns the raw texture of fileID, or nil if the source doesn't
+	// have it. Sources that support it only answer notModified if cached is
+	// still current.
+	fetch(fileID string, prio priority, cached *file) (*fetchedTexture, error)
+}
+
+type upstreamSource struct {
+	client *upstreamClient
+}
+
+func (source *upstreamSource) name() string {
+	return "upstream"
+}
+
+func (source *upstreamSource) fetch(fileID string, prio priority, cached *file) (*fetchedTexture, error) {
+	header := http.Header{}
+	if cached != nil && cached.etag != "" {
+		header.Set("If-None-Match", cached.etag)
+	}
+	if cached != nil && cached.upstreamModified != "" {
+		header.Set("If-Modified-Since", cached.upstreamModified)
+	}
+
+	response, err := source.client.fetchFile(fileID, prio, header)
+	if statusErr, ok := err.(*upstreamStatusError); ok && statusErr.statusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if response.statusCode == http.StatusNotModified {
+		return &fetchedTexture{
+			notModified: true,
+		}, nil
+	}
+
+	return &fetchedTexture{
+		content: unwrapTexture(response.body),
+
+		etag:             response.header.Get("ETag"),
+		upstreamModified: response.header.Get("Last-Modified"),
+	}, nil
+}
+
+type archiveSource struct {
+	archive *datFile.Archive
+}
+
+func (source *archiveSource) name() string {
+	return "archive"
+}
+
+func (source *archiveSource) fetch(fileID string, _ priority, _ *file) (*fetchedTexture, error) {
+	id, err := strconv.ParseUint(fileID, 10, 32)
+	if err != nil {
+		return nil, nil
+	}
+
+	content, err := source.archive.ReadFile(uint32(id))
+	if err != nil || content == nil {
+		return nil, err
+	}
+
+	return &fetchedTexture{
+		content: content,
+	}, nil
+}
@@ -0,0 +1,256 @@
+package gw2imageserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+const sqliteMaxBatch = 64
+
+var errDBClosed = errors.New("database is closed")
+
+type SQLiteConfig struct {
+	Path string
+
+	// Readers caps the read-only connections. Writes always share a single
+	// connection, concurrent writes are committed together.
+	Readers     int
+	BusyTimeout time.Duration
+}
+
+// sqliteDB separates a pool of read-only connections from the one writer
+// connection. In WAL mode readers never wait for the writer.
+type sqliteDB struct {
+	reader *sql.DB
+	writer *sql.DB
+
+	writes   chan *sqliteWrite
+	stopping chan struct{}
+	stopped  chan struct{}
+
+	// statements prepared on reader or writer, closed with them
+	statements []*sql.Stmt
+}
+
+type sqliteWrite struct {
+	fn   func(tx *sql.Tx) error
+	done chan error
+}
+
+func sqliteDSN(config SQLiteConfig, params url.Values) string {
+	params.Set("_busy_timeout", fmt.Sprint(config.BusyTimeout.Milliseconds()))
+
+	return "file:" + config.Path + "?" + params.Encode()
+}
+
+// openSQLiteWriter opens the writer connection, which also runs migrations.
+func openSQLiteWriter(config SQLiteConfig) (*sql.DB, error) {
+	writer, err := sql.Open("sqlite3", sqliteDSN(config, url.Values{
+		"_journal_mode": {"WAL"},
+		"_synchronous":  {"NORMAL"},
+		"_txlock":       {"immediate"},
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	writer.SetMaxOpenConns(1)
+	writer.SetMaxIdleConns(1)
+	writer.SetConnMaxLifetime(0)
+
+	if err := writer.Ping(); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// enableIncrementalVacuum lets compact shrink the database file. Databases
+// created without it are converted by a VACUUM, once.
+func enableIncrementalVacuum(writer *sql.DB) error {
+	const incremental = 2
+
+	mode := 0
+	if err := writer.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	} else if mode == incremental {
+		return nil
+	}
+
+	log.Printf("[enableIncrementalVacuum] rewriting the database once, this may take a while")
+
+	if _, err := writer.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return err
+	}
+	_, err := writer.Exec("VACUUM")
+
+	return err
+}
+
+func openSQLite(config SQLiteConfig) (*sqliteDB, error) {
+	if config.Readers < 1 {
+		config.Readers = 1
+	}
+
+	writer, err := openSQLiteWriter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(writer); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err := enableIncrementalVacuum(writer); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+
+	reader, err := sql.Open("sqlite3", sqliteDSN(config, url.Values{
+		"mode": {"ro"},
+	}))
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+
+	reader.SetMaxOpenConns(config.Readers)
+	reader.SetMaxIdleConns(config.Readers)
+
+	db := &sqliteDB{
+		reader: reader,
+		writer: writer,
+
+		writes:   make(chan *sqliteWrite),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go db.runWrites()
+
+	log.Printf("[openSQLite] path=%v readers=%v", config.Path, config.Readers)
+
+	return db, nil
+}
+
+// write runs fn in a transaction shared with other writes queued meanwhile,
+// and returns once that transaction is committed.
+func (db *sqliteDB) write(fn func(tx *sql.Tx) error) error {
+	write := &sqliteWrite{
+		fn:   fn,
+		done: make(chan error, 1),
+	}
+
+	select {
+	case db.writes <- write:
+	case <-db.stopping:
+		return errDBClosed
+	}
+
+	return <-write.done
+}
+
+// runWrites commits writes as they come in. While one batch is being
+// committed the next one queues up, so batches grow with the load without
+// delaying single writes.
+func (db *sqliteDB) runWrites() {
+	defer close(db.stopped)
+
+	for {
+		var batch []*sqliteWrite
+
+		select {
+		case write := <-db.writes:
+			batch = append(batch, write)
+		case <-db.stopping:
+			return
+		}
+
+	collect:
+		for len(batch) < sqliteMaxBatch {
+			select {
+			case write := <-db.writes:
+				batch = append(batch, write)
+			default:
+				break collect
+			}
+		}
+
+		db.commit(batch)
+	}
+}
+
+// commit applies a batch in one transaction. If that fails, every write is
+// retried on its own, so one bad write doesn't fail the others.
+func (db *sqliteDB) commit(batch []*sqliteWrite) {
+	err := db.apply(batch)
+	if err == nil || len(batch) == 1 {
+		for _, write := range batch {
+			write.done <- err
+		}
+		return
+	}
+
+	log.Printf("[sqliteDB] batch of %v failed, retrying one by one: %v", len(batch), err)
+
+	for _, write := range batch {
+		write.done <- db.apply([]*sqliteWrite{write})
+	}
+}
+
+func (db *sqliteDB) apply(batch []*sqliteWrite) error {
+	tx, err := db.writer.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, write := range batch {
+		if err := write.fn(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) close() error {
+	close(db.stopping)
+	<-db.stopped
+
+	for _, statement := range db.statements {
+		_ = statement.Close()
+	}
+
+	readerErr := db.reader.Close()
+	if err := db.writer.Close(); err != nil {
+		return err
+	}
+
+	return readerErr
+}
+
+type sqlStatement struct {
+	statement **sql.Stmt
+	query     string
+}
+
+// prepareAll prepares statements on pool, which is the reader or the writer.
+func (db *sqliteDB) prepareAll(pool *sql.DB, statements ...sqlStatement) error {
+	for _, statement := range statements {
+		prepared, err := pool.Prepare(statement.query)
+		if err != nil {
+			return fmt.Errorf("couldn't prepare %q: %v", statement.query, err)
+		}
+
+		*statement.statement = prepared
+		db.statements = append(db.statements, prepared)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+)
+
+const (
+	storageBackendSQLite     = "sqlite"
+	storageBackendFilesystem = "filesystem"
+	storageBackendS3         = "s3"
+)
+
+// storage keeps raw files and everything derived from them, keyed by file
+// ID and file type.
+type storage interface {
+	// get and getMetadata return nil if the file isn't stored; getMetadata
+	// leaves content empty.
+	get(fileID string, fileType string) (*file, error)
+	getMetadata(fileID string, fileType string) (*file, error)
+
+	// save expects file.hash to be set.
+	save(file *file) error
+	touch(file *file) error
+
+	delete(fileID string, fileType string) error
+	// deleteDerived removes everything but the raw file of fileID.
+	deleteDerived(fileID string) error
+}
+
+// storageOpener is implemented by backends keeping every file on disk, so it
+// can be sent to the client without being read into memory first.
+type storageOpener interface {
+	// open returns nil if the file isn't stored.
+	open(fileID string, fileType string) (io.ReadCloser, error)
+}
+
+func (app *app) initStorage(config CacheConfig) error {
+	switch config.Backend {
+	case "", storageBackendSQLite:
+		storage, err := newSQLiteStorage(app.db)
+		if err != nil {
+			return err
+		}
+		app.storage = storage
+	case storageBackendFilesystem:
+		storage, err := newFilesystemStorage(config.Directory)
+		if err != nil {
+			return err
+		}
+		app.storage = storage
+	case storageBackendS3:
+		storage, err := newS3Storage(config.S3)
+		if err != nil {
+			return err
+		}
+		app.storage = storage
+	default:
+		return fmt.Errorf("unknown cache backend: %v", config.Backend)
+	}
+
+	log.Printf("[initStorage] backend=%v", config.Backend)
+
+	return nil
+}
+
+func (app *app) getFileFromCache(fileToLookup string, fileTypeToLookup string) (*file, error) {
+	if cached := app.memory.get(fileToLookup, fileTypeToLookup); cached != nil {
+		return cached, nil
+	}
+
+	log.Printf("[getFileFromCache] fileToLookup=%v type=%v", fileToLookup, fileTypeToLookup)
+
+	cached, err := app.storage.get(fileToLookup, fileTypeToLookup)
+	if err != nil || cached == nil {
+		return nil, err
+	}
+
+	if app.cacheConfig.VerifyReads > 0 && rand.Float64() < app.cacheConfig.VerifyReads && !verifyHash(cached) {
+		log.Printf("[getFileFromCache] %v %v is corrupt, dropping it", cached.file, cached.fileType)
+		return nil, app.deleteFileFromCache(cached.file, cached.fileType)
+	}
+
+	app.memory.add(cached)
+
+	return cached, nil
+}
+
+func contentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyHash reports whether the content of file matches its hash. Files
+// stored before hashes existed have none and always pass.
+func verifyHash(file *file) bool {
+	return file.hash == "" || file.hash == contentHash(file.content)
+}
+
+// getFileMetadataFromCache is getFileFromCache without the content.
+func (app *app) getFileMetadataFromCache(fileToLookup string, fileTypeToLookup string) (*file, error) {
+	if cached := app.memory.peek(fileToLookup, fileTypeToLookup); cached != nil {
+		cached.content = nil
+		return cached, nil
+	}
+
+	return app.storage.getMetadata(fileToLookup, fileTypeToLookup)
+}
+
+func (app *app) saveFileToCache(file *file) error {
+	log.Printf("[saveFileToCache] file=%v type=%v size=%v time=%v", file.file, file.fileType, len(file.content), file.lastModified)
+
+	file.hash = contentHash(file.content)
+
+	replaced, err := app.replacedRaw(file)
+	if err != nil {
+		return err
+	}
+
+	if err := app.storage.save(file); err != nil {
+		app.memory.remove(file.file, file.fileType)
+		return err
+	}
+
+	app.memory.add(file)
+
+	// variants aren't checked against their source when served
+	if replaced != nil && replaced.hash != file.hash {
+		return app.deleteDerivedFilesFromCache(file.file)
+	}
+
+	return nil
+}
+
+// replacedRaw returns the stored raw file that saving saved replaces, if
+// saved is a raw file.
+func (app *app) replacedRaw(saved *file) (*file, error) {
+	if saved.fileType != "uncompressed" {
+		return nil, nil
+	}
+
+	return app.storage.getMetadata(saved.file, saved.fileType)
+}
+
+func (app *app) touchFileInCache(file *file) error {
+	app.memory.touch(file)
+
+	return app.storage.touch(file)
+}
+
+func (app *app) deleteFileFromCache(fileToDelete string, fileTypeToDelete string) error {
+	log.Printf("[deleteFileFromCache] file=%v type=%v", fileToDelete, fileTypeToDelete)
+
+	app.memory.remove(fileToDelete, fileTypeToDelete)
+
+	return app.storage.delete(fileToDelete, fileTypeToDelete)
+}
+
+// deleteDerivedFilesFromCache removes everything generated from the raw file.
+func (app *app) deleteDerivedFilesFromCache(fileToDelete string) error {
+	log.Printf("[deleteDerivedFilesFromCache] file=%v", fileToDelete)
+
+	app.memory.removeDerived(fileToDelete)
+
+	return app.storage.deleteDerived(fileToDelete)
+}
+
+// openFileInCache returns the content of a file looked up with
+// getFileMetadataFromCache, or nil if it vanished in the meantime. Small
+// files go through the memory cache, the rest is streamed if the backend can.
+func (app *app) openFileInCache(metadata *file) (io.ReadCloser, error) {
+	opener, canOpen := app.storage.(storageOpener)
+
+	if canOpen && !app.memory.fits(metadata.size) {
+		return opener.open(metadata.file, metadata.fileType)
+	}
+
+	cached, err := app.getFileFromCache(metadata.file, metadata.fileType)
+	if err != nil || cached == nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(cached.content)), nil
+}
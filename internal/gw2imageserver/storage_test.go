@@ -0,0 +1,57 @@
+package gw2imageserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestCorruptSharedBlobsAreRepaired drops an entry whose blob is corrupt and
+// fetches it again, which has to repair the blob the other entry shares.
+func TestCorruptSharedBlobsAreRepaired(t *testing.T) {
+	for backend, corrupt := range map[string]func(app *app, hash string) error{
+		storageBackendSQLite: func(app *app, hash string) error {
+			_, err := app.db.writer.Exec(`UPDATE blob SET content = ? WHERE sha256 = ?`, []byte("corrupt"), hash)
+			return err
+		},
+		storageBackendFilesystem: func(app *app, hash string) error {
+			storage := app.storage.(*filesystemStorage)
+			return ioutil.WriteFile(storage.blobPath(hash), []byte("corrupt"), 0644)
+		},
+	} {
+		t.Run(backend, func(t *testing.T) {
+			app := newTestApp(t, func(config *Config) {
+				config.Cache.Backend = backend
+				config.Cache.VerifyReads = 1
+			})
+
+			content := []byte("shared content")
+			for _, fileID := range []string{"1", "2"} {
+				if err := app.saveFileToCache(testFile(fileID, "png", content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			app.memory = newMemoryCache(0)
+
+			if err := corrupt(app, contentHash(content)); err != nil {
+				t.Fatal(err)
+			}
+
+			if dropped, err := app.getFileFromCache("1", "png"); err != nil || dropped != nil {
+				t.Fatalf("got %v, %v for a corrupt entry", dropped, err)
+			}
+			if err := app.saveFileToCache(testFile("1", "png", content)); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, fileID := range []string{"1", "2"} {
+				repaired, err := app.getFileFromCache(fileID, "png")
+				if err != nil {
+					t.Fatal(err)
+				} else if repaired == nil || !bytes.Equal(repaired.content, content) {
+					t.Fatalf("%v wasn't repaired: %+v", fileID, repaired)
+				}
+			}
+		})
+	}
+}
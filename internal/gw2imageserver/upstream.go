@@ -0,0 +1,307 @@
+package gw2imageserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type UpstreamConfig struct {
+	// Disabled keeps the server offline, textures only come from the archive.
+	Disabled bool
+
+	// Mirrors are tried in order. A mirror is either a base URL that FilePath
+	// is appended to or a complete template containing {file}.
+	Mirrors  []string
+	FilePath string
+
+	LatestPath   string
+	ManifestPath string
+
+	Headers map[string]string
+	Cookies map[string]string
+
+	Timeout time.Duration
+
+	MaxAttempts int
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RateLimit is in requests per second, 0 means unlimited.
+	RateLimit     float64
+	RateBurst     int
+	MaxConcurrent int
+
+	Cassette CassetteConfig
+	Faults   FaultConfig
+}
+
+type upstreamResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+type upstreamStatusError struct {
+	statusCode int
+	url        string
+}
+
+func (err *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with %v for %v", err.statusCode, err.url)
+}
+
+type mirror struct {
+	base     string
+	template string
+	breaker  *circuitBreaker
+}
+
+type upstreamClient struct {
+	config UpstreamConfig
+
+	httpClient *http.Client
+	mirrors    []*mirror
+	limiter    *upstreamLimiter
+	faults     *faultTransport
+}
+
+type upstreamStatus struct {
+	Mirrors []breakerStatus `json:"mirrors"`
+	Limiter limiterStatus   `json:"limiter"`
+}
+
+func newUpstreamClient(config UpstreamConfig) (*upstreamClient, error) {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	if config.BreakerThreshold < 1 {
+		config.BreakerThreshold = 1
+	}
+
+	transport, err := newCassetteTransport(config.Cassette, http.DefaultTransport)
+	if err != nil {
+		return nil, err
+	}
+
+	faults := newFaultTransport(FaultConfig{}, transport)
+	if err := faults.setConfig(config.Faults); err != nil {
+		return nil, err
+	}
+
+	client := upstreamClient{
+		config: config,
+
+		httpClient: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: faults,
+		},
+		faults:  faults,
+		limiter: newUpstreamLimiter(config.RateLimit, config.RateBurst, config.MaxConcurrent),
+	}
+
+	for _, location := range config.Mirrors {
+		base := strings.TrimRight(location, "/")
+		template := base + config.FilePath
+
+		if strings.Contains(location, "{file}") {
+			template = location
+			if parsed, err := url.Parse(location); err == nil {
+				base = parsed.Scheme + "://" + parsed.Host
+			}
+		}
+
+		client.mirrors = append(client.mirrors, &mirror{
+			base:     base,
+			template: template,
+			breaker:  newCircuitBreaker(location, config.BreakerThreshold, config.BreakerCooldown),
+		})
+	}
+
+	return &client, nil
+}
+
+func (client *upstreamClient) status() upstreamStatus {
+	status := upstreamStatus{
+		Mirrors: make([]breakerStatus, 0, len(client.mirrors)),
+		Limiter: client.limiter.status(),
+	}
+
+	for _, mirror := range client.mirrors {
+		status.Mirrors = append(status.Mirrors, mirror.breaker.status())
+	}
+
+	return status
+}
+
+func (client *upstreamClient) newRequest(location string, header http.Header) (*http.Request, error) {
+	request, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range client.config.Headers {
+		request.Header.Set(name, value)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	for name, value := range client.config.Cookies {
+		request.AddCookie(&http.Cookie{
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	return request, nil
+}
+
+// fetchFile requests fileID, header may carry conditional request headers in
+// which case a 304 response is returned instead of an error.
+func (client *upstreamClient) fetchFile(fileID string, prio priority, header http.Header) (*upstreamResponse, error) {
+	return client.fetch(func(mirror *mirror) string {
+		return strings.Replace(mirror.template, "{file}", fileID, -1)
+	}, prio, header)
+}
+
+func (client *upstreamClient) fetchPath(path string, prio priority) (*upstreamResponse, error) {
+	return client.fetch(func(mirror *mirror) string {
+		return mirror.base + path
+	}, prio, nil)
+}
+
+// fetch asks every healthy mirror in order until one of them answers.
+func (client *upstreamClient) fetch(urlFor func(*mirror) string, prio priority, header http.Header) (*upstreamResponse, error) {
+	if len(client.mirrors) == 0 {
+		return nil, fmt.Errorf("no upstream mirrors configured")
+	}
+
+	var lastErr error = errBreakerOpen
+
+	for _, mirror := range client.mirrors {
+		request, err := client.newRequest(urlFor(mirror), header)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := client.do(mirror.breaker, request, prio)
+		if err == nil {
+			return response, nil
+		}
+
+		if err == errUpstreamBusy {
+			// every mirror shares the limiter, don't wait for it again
+			return nil, err
+		}
+		if err == errBreakerOpen && lastErr != errBreakerOpen {
+			// keep the more meaningful error of an earlier mirror
+			continue
+		}
+
+		log.Printf("[upstream] %v failed, trying next mirror: %v", mirror.breaker.name, err)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+func isIdempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// backoff returns a full-jitter exponential delay for the given retry.
+func (client *upstreamClient) backoff(retry int) time.Duration {
+	delay := client.config.BackoffBase << uint(retry)
+	if delay <= 0 || delay > client.config.BackoffMax {
+		delay = client.config.BackoffMax
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+func (client *upstreamClient) do(breaker *circuitBreaker, request *http.Request, prio priority) (*upstreamResponse, error) {
+	attempts := client.config.MaxAttempts
+	if !isIdempotent(request.Method) {
+		attempts = 1
+	}
+
+	var lastErr error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := client.backoff(attempt - 1)
+			log.Printf("[upstream] retry %v/%v for %v in %v: %v", attempt, attempts-1, request.URL, delay, lastErr)
+			time.Sleep(delay)
+		}
+
+		if err := breaker.allow(); err != nil {
+			return nil, err
+		}
+
+		// waiting for a slot shares the deadline of the request itself
+		release, err := client.limiter.acquire(prio, client.config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		response, err := client.attempt(request)
+		release()
+
+		if err == nil {
+			breaker.success()
+			return response, nil
+		}
+
+		lastErr = err
+
+		if statusErr, ok := err.(*upstreamStatusError); ok && !isRetryableStatus(statusErr.statusCode) {
+			// the upstream answered, it just doesn't have what we asked for
+			breaker.success()
+			return nil, err
+		}
+
+		breaker.failure(err)
+	}
+
+	return nil, lastErr
+}
+
+func (client *upstreamClient) attempt(request *http.Request) (*upstreamResponse, error) {
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotModified {
+		return nil, &upstreamStatusError{
+			statusCode: response.StatusCode,
+			url:        request.URL.String(),
+		}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstreamResponse{
+		statusCode: response.StatusCode,
+		header:     response.Header,
+		body:       body,
+	}, nil
+}
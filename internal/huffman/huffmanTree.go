@@ -1,6 +1,7 @@
 package huffman
 
 import (
+	"fmt"
 	"log"
 )
 
@@ -14,6 +15,7 @@ type HuffmanTree interface {
 	IsEmpty() bool
 	GetSymbolValueHash(uint32) uint16
 	GetSymbolValue(uint32) uint16
+	GetSymbolValueOffset(uint32) uint16
 	GetCodeBitsHash(uint32) uint8
 	GetCodeBits(uint32) uint8
 	GetCodeComp(uint32) uint32
@@ -43,6 +45,10 @@ func (tree *huffmanTree) GetSymbolValue(symbol uint32) uint16 {
 	return tree.symbolValueTab[symbol]
 }
 
+func (tree *huffmanTree) GetSymbolValueOffset(index uint32) uint16 {
+	return tree.symbolValueTabOffsetTab[index]
+}
+
 func (tree *huffmanTree) GetCodeBitsHash(code uint32) uint8 {
 	return tree.codeBitsHashTab[code]
 }
@@ -62,89 +68,111 @@ func memset(ptr *[]uint16, value uint16, count uint32) {
 	}
 }
 
-func NewHuffmanTree() HuffmanTree {
-	tree := huffmanTree{}
+type Builder struct {
+	workingBitTab  [maxCodeBitsLength]uint16
+	workingCodeTab [maxSymbolValue]uint16
+}
 
-	var aWorkingBitTab [maxCodeBitsLength]uint16
-	var aWorkingCodeTab [maxSymbolValue]uint16
+func NewBuilder() *Builder {
+	builder := Builder{}
 
-	workingBitTab := aWorkingBitTab[:]
-	workingCodeTab := aWorkingCodeTab[:]
+	workingBitTab := builder.workingBitTab[:]
+	workingCodeTab := builder.workingCodeTab[:]
 
 	// Initialize our workingTabs
 	memset(&workingBitTab, 0xFFFF, maxCodeBitsLength)
 	memset(&workingCodeTab, 0xFFFF, maxSymbolValue)
 
-	fillWorkingTabsHelper(1, 0x01, &workingBitTab, &workingCodeTab)
-
-	fillWorkingTabsHelper(2, 0x12, &workingBitTab, &workingCodeTab)
-
-	fillWorkingTabsHelper(6, 0x11, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x10, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0F, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0E, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0D, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0C, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0B, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x0A, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x09, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x08, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x07, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x06, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x05, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x04, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x03, &workingBitTab, &workingCodeTab)
-	fillWorkingTabsHelper(6, 0x02, &workingBitTab, &workingCodeTab)
-
-	// log.Printf("workingBitTab\n")
-	// for _, v := range workingBitTab {
-	// 	fmt.Printf("%04x\n", uint16(v))
-	// }
-	// log.Printf("workingCodeTab\n")
-	// for _, v := range workingCodeTab {
-	// 	fmt.Printf("%04x\n", uint16(v))
-	// }
+	return &builder
+}
+
+// AddSymbol registers a symbol with a code of iBits bits. Symbols sharing a
+// code length are assigned codes in reverse order of registration.
+func (builder *Builder) AddSymbol(iBits uint8, iSymbol uint16) error {
+	workingBitTab := builder.workingBitTab[:]
+	workingCodeTab := builder.workingCodeTab[:]
+
+	return fillWorkingTabsHelper(iBits, iSymbol, &workingBitTab, &workingCodeTab)
+}
+
+func (builder *Builder) Build() HuffmanTree {
+	tree := huffmanTree{
+		isEmpty: true,
+	}
+
+	workingBitTab := builder.workingBitTab[:]
+	workingCodeTab := builder.workingCodeTab[:]
 
 	tree.buildHuffmanTree(&workingBitTab, &workingCodeTab)
 
-	// fmt.Printf("codeCompTab: ")
-	// for _, v := range tree.codeCompTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+	return &tree
+}
 
-	// fmt.Printf("\nsymbolValueTabOffsetTab: ")
-	// for _, v := range tree.symbolValueTabOffsetTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+func mustAddSymbols(builder *Builder, iBits uint8, iSymbols ...uint16) {
+	for _, symbol := range iSymbols {
+		if err := builder.AddSymbol(iBits, symbol); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+}
 
-	// fmt.Printf("\nsymbolValueTab: ")
-	// for _, v := range tree.symbolValueTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+func NewHuffmanTree() HuffmanTree {
+	builder := NewBuilder()
 
-	// fmt.Printf("\ncodeBitsTab: ")
-	// for _, v := range tree.codeBitsTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+	mustAddSymbols(builder, 1, 0x01)
 
-	// fmt.Printf("\nsymbolValueHashTab: ")
-	// for _, v := range tree.symbolValueHashTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+	mustAddSymbols(builder, 2, 0x12)
 
-	// fmt.Printf("\ncodeBitsHashTab: ")
-	// for _, v := range tree.codeBitsHashTab {
-	// 	fmt.Printf("%x ", v)
-	// }
+	mustAddSymbols(builder, 6,
+		0x11, 0x10, 0x0F, 0x0E, 0x0D, 0x0C, 0x0B, 0x0A,
+		0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02)
 
-	// fmt.Println()
+	return builder.Build()
+}
 
-	return &tree
+// NewDictionaryTree returns the static tree used to read the code lengths of
+// the trees embedded in ArenaNet compressed archive data.
+func NewDictionaryTree() HuffmanTree {
+	builder := NewBuilder()
+
+	mustAddSymbols(builder, 3, 0x0A, 0x09, 0x08)
+	mustAddSymbols(builder, 4, 0x0C, 0x0B, 0x07, 0x00)
+	mustAddSymbols(builder, 5, 0xE0, 0x2A, 0x29, 0x06)
+	mustAddSymbols(builder, 6, 0x4A, 0x40, 0x2C, 0x2B, 0x28, 0x20, 0x05, 0x04)
+	mustAddSymbols(builder, 7, 0x49, 0x48, 0x27, 0x26, 0x25, 0x0D, 0x03)
+	mustAddSymbols(builder, 8, 0x6A, 0x69, 0x4C, 0x4B, 0x47, 0x24)
+	mustAddSymbols(builder, 9, 0xE8, 0xA0, 0x89, 0x88, 0x68, 0x67, 0x63, 0x60, 0x46, 0x23)
+	mustAddSymbols(builder, 10,
+		0xE9, 0xC9, 0xC0, 0xA9, 0xA8, 0x8A, 0x87, 0x80,
+		0x66, 0x65, 0x45, 0x44, 0x43, 0x2D, 0x02, 0x01)
+	mustAddSymbols(builder, 11,
+		0xE5, 0xC8, 0xAA, 0xA5, 0xA4, 0x8B, 0x85, 0x84,
+		0x6C, 0x6B, 0x64, 0x4D, 0x0E)
+	mustAddSymbols(builder, 12, 0xE7, 0xCA, 0xC7, 0xA7, 0xA6, 0x86, 0x83)
+	mustAddSymbols(builder, 13, 0xE6, 0xE4, 0xC4, 0x8C, 0x2E, 0x22)
+	mustAddSymbols(builder, 14, 0xEC, 0xC6, 0x6D, 0x4E)
+	mustAddSymbols(builder, 15, 0xEA, 0xCC, 0xAC, 0xAB, 0x8D, 0x11, 0x10, 0x0F)
+
+	// every remaining byte value has a 16 bit code
+	var shortCodes [0x100]bool
+	for bits := uint8(3); bits < 16; bits++ {
+		for symbol := builder.workingBitTab[bits]; symbol != 0xFFFF; symbol = builder.workingCodeTab[symbol] {
+			shortCodes[symbol] = true
+		}
+	}
+	for symbol := 0xFF; symbol >= 0; symbol-- {
+		if !shortCodes[symbol] {
+			mustAddSymbols(builder, 16, uint16(symbol))
+		}
+	}
+
+	return builder.Build()
 }
 
 func (tree *huffmanTree) buildHuffmanTree(workingBitTab *[]uint16, workingCodeTab *[]uint16) {
+	// codes longer than MaxNbBitsHash have no hash entry, symbols never reach 0xFFFF
 	for i := range tree.symbolValueHashTab {
-		tree.symbolValueHashTab[i] = 0xFF
+		tree.symbolValueHashTab[i] = 0xFFFF
 	}
 
 	aCode, aNbBits := tree.fillFirstPart(workingBitTab, workingCodeTab)
@@ -215,13 +243,13 @@ func (tree *huffmanTree) fillFirstPart(workingBitTab *[]uint16, workingCodeTab *
 }
 
 func fillWorkingTabsHelper(
-	iBits uint8, iSymbol uint16, workingBitTab *[]uint16, workingCodeTab *[]uint16) {
+	iBits uint8, iSymbol uint16, workingBitTab *[]uint16, workingCodeTab *[]uint16) error {
 
 	if uint32(iBits) >= maxCodeBitsLength {
-		log.Fatalf("Too many bits, got %v expected less than %v", iBits, maxCodeBitsLength)
+		return fmt.Errorf("too many bits, got %v expected less than %v", iBits, maxCodeBitsLength)
 	}
 	if uint16(iSymbol) >= uint16(maxSymbolValue) {
-		log.Fatalf("Too gith symbol, got %v expected less than %v", iSymbol, maxSymbolValue)
+		return fmt.Errorf("too high symbol, got %v expected less than %v", iSymbol, maxSymbolValue)
 	}
 
 	if (*workingBitTab)[iBits] == 0xFFFF {
@@ -230,4 +258,6 @@ func fillWorkingTabsHelper(
 		(*workingCodeTab)[iSymbol] = (*workingBitTab)[iBits]
 		(*workingBitTab)[iBits] = iSymbol
 	}
+
+	return nil
 }
@@ -0,0 +1,65 @@
+package huffman
+
+import (
+	"testing"
+)
+
+func TestBuilderRejectsInvalidSymbols(t *testing.T) {
+	builder := NewBuilder()
+
+	if err := builder.AddSymbol(uint8(maxCodeBitsLength), 1); err == nil {
+		t.Fatal("want an error for too many bits")
+	}
+	if err := builder.AddSymbol(1, uint16(maxSymbolValue)); err == nil {
+		t.Fatal("want an error for too high a symbol")
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	if !NewBuilder().Build().IsEmpty() {
+		t.Fatal("a tree without symbols has to be empty")
+	}
+}
+
+func TestHashTable(t *testing.T) {
+	builder := NewBuilder()
+	for _, symbol := range []uint16{3, 2, 1} {
+		if err := builder.AddSymbol(2, symbol); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := builder.Build()
+
+	// codes are assigned from the top, the last registered symbol first
+	for hash, want := range map[uint32]uint16{0xC0: 1, 0x80: 2, 0x40: 3, 0x00: 0xFFFF} {
+		if got := tree.GetSymbolValueHash(hash); got != want {
+			t.Errorf("hash %#x: got symbol %#x, want %#x", hash, got, want)
+		}
+		if want != 0xFFFF && tree.GetCodeBitsHash(hash) != 2 {
+			t.Errorf("hash %#x: got %v bits, want 2", hash, tree.GetCodeBitsHash(hash))
+		}
+	}
+}
+
+func TestDictionaryTreeCoversAllBytes(t *testing.T) {
+	tree := NewDictionaryTree()
+
+	seen := map[uint16]bool{}
+	for hash := uint32(0); hash < 1<<MaxNbBitsHash; hash++ {
+		if symbol := tree.GetSymbolValueHash(hash); symbol != 0xFFFF {
+			seen[symbol] = true
+		}
+	}
+	for index := uint32(0); index < maxCodeBitsLength && tree.GetCodeBits(index) != 0; index++ {
+		count := uint32(tree.GetSymbolValueOffset(index)) + 1
+		for symbol := uint32(0); symbol < count; symbol++ {
+			seen[tree.GetSymbolValue(symbol)] = true
+		}
+	}
+
+	for symbol := uint16(0); symbol < 0x100; symbol++ {
+		if !seen[symbol] {
+			t.Errorf("symbol %#x has no code", symbol)
+		}
+	}
+}
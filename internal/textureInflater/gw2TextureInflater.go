@@ -503,7 +503,7 @@ func (state *inflaterState) readCode() (ioCode uint16, err error) {
 		}
 
 		aNbBits := state.huffmanTree.GetCodeBits(anIndex)
-		symbol = uint32(state.huffmanTree.GetSymbolValueHash(anIndex)) -
+		symbol = uint32(state.huffmanTree.GetSymbolValueOffset(anIndex)) -
 			((tmp - state.huffmanTree.GetCodeComp(anIndex)) >> (32 - aNbBits))
 
 		ioCode = state.huffmanTree.GetSymbolValue(symbol)